@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"golang.org/x/crypto/openpgp"
+	cryptorand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"github.com/gorilla/securecookie"
@@ -316,6 +318,102 @@ func postPostsByUser(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func showBans(w http.ResponseWriter, r *http.Request) {
+	if !getStaffRole(r).ManageBans {
+		return
+	}
+
+	data := struct {
+		Bans       []*userBan
+		BanReasons map[string]banReason
+	}{siteUsers.ActiveBans(), settings.BanReasons}
+
+	if e := templates.ExecuteTemplate(w, "ban_list", data); e != nil {
+		log.Println(e)
+	}
+}
+
+func postEditBan(w http.ResponseWriter, r *http.Request) {
+	if !getStaffRole(r).ManageBans {
+		return
+	}
+
+	r.ParseForm()
+	addr := r.Form.Get("addr")
+	days, e := strconv.ParseUint(r.Form.Get("ban_length"), 10, 64)
+	if addr == "" || e != nil {
+		msg(w, 200, "invalid_fields")
+		return
+	}
+
+	log.Printf("%s setting ban length for %s to %d days",
+		getStaffName(r), addr, days)
+
+	if e := siteUsers.EditBan(addr, days); e != nil {
+		msg(w, 200, e.Error())
+		return
+	}
+
+	passthrough(w, "ban_updated", "/admin_bans")
+}
+
+func postRevokeBan(w http.ResponseWriter, r *http.Request) {
+	if !getStaffRole(r).ManageBans {
+		return
+	}
+
+	r.ParseForm()
+	addr := r.Form.Get("addr")
+	reason := r.Form.Get("revoke_reason")
+	if addr == "" || reason == "" {
+		msg(w, 200, "invalid_fields")
+		return
+	}
+
+	staffName := getStaffName(r)
+	log.Printf("%s revoking ban for %s: %s", staffName, addr, reason)
+
+	if e := siteUsers.RevokeBan(addr, staffName, reason); e != nil {
+		msg(w, 200, e.Error())
+		return
+	}
+
+	passthrough(w, "ban_revoked", "/admin_bans")
+}
+
+func postAppealDecision(w http.ResponseWriter, r *http.Request) {
+	if !getStaffRole(r).ManageBans {
+		return
+	}
+
+	r.ParseForm()
+	addr := r.Form.Get("addr")
+	decision := r.Form.Get("decision")
+	response := r.Form.Get("response")
+	if addr == "" || (decision != "accept" && decision != "deny") {
+		msg(w, 200, "invalid_fields")
+		return
+	}
+
+	staffName := getStaffName(r)
+	log.Printf("%s decided to %s appeal for %s", staffName, decision, addr)
+
+	appeal, e := siteUsers.DecideAppeal(addr, staffName, response,
+		decision == "accept")
+	if e != nil {
+		msg(w, 200, e.Error())
+		return
+	}
+
+	hiveReq(func(h *hive) {
+		if p := h.GetPost(appeal.Post); p != nil {
+			h.HidePost(p)
+		}
+	})
+
+	passthrough(w, "appeal_decided", "/admin_bans")
+}
+
 // Fill out mail template and send to admin.
 func mailNotify(ip string, p *post) {
 	log.Println("mailNotify")
@@ -404,6 +502,15 @@ func randomBytes(length int) []byte {
 	return b
 }
 
+// A hex token from crypto/rand, for secrets which must not be guessable.
+func secureToken(length int) (string, error) {
+	b := make([]byte, length)
+	if _, e := cryptorand.Read(b); e != nil {
+		return "", e
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func initSessionStore() *sessions.CookieStore {
 	rKey := securecookie.GenerateRandomKey
 	return sessions.NewCookieStore(rKey(64), rKey(32))
@@ -0,0 +1,235 @@
+//
+// api.go
+//
+// Read-only JSON views of tag queries, threads and posts, served under a
+// versioned path prefix. Thread and post JSON is cached in pageCache along
+// with the templated thread pages.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/api/v1/"
+
+type apiHan struct {
+	Char  string   `json:"char"`
+	Color hslColor `json:"color"`
+	Ident uint64   `json:"ident"`
+}
+
+type apiMedia struct {
+	Hash   string `json:"hash"`
+	SHA256 string `json:"sha256"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Info   string `json:"info"`
+	Size   int    `json:"size"`
+	Thumb  string `json:"thumb"`
+	Full   string `json:"full"`
+}
+
+type apiPost struct {
+	Gid     postGid   `json:"gid"`
+	Lid     postLid   `json:"lid"`
+	Thread  threadId  `json:"thread"`
+	ReplyTo postLid   `json:"reply_to,omitempty"`
+	Replies []postLid `json:"replies"`
+	Time    time.Time `json:"time"`
+	Comment string    `json:"comment"`
+	Han     apiHan    `json:"han"`
+	Role    string    `json:"role,omitempty"`
+	Media   *apiMedia `json:"media,omitempty"`
+}
+
+type apiThread struct {
+	Id         threadId     `json:"id"`
+	RandomMark uint         `json:"random_mark"`
+	Updated    time.Time    `json:"updated"`
+	Tags       []string     `json:"tags"`
+	StickyTags []string     `json:"sticky_tags"`
+	Locked     bool         `json:"locked"`
+	Nsfw       bool         `json:"nsfw"`
+	Count      contentCount `json:"count"`
+	Posts      []apiPost    `json:"posts,omitempty"`
+}
+
+type apiQuery struct {
+	Merge      []string    `json:"merge"`
+	Filter     []string    `json:"filter"`
+	Exclude    []string    `json:"exclude"`
+	Expression string      `json:"expression,omitempty"`
+	Sort       string      `json:"sort"`
+	Page       int         `json:"page"`
+	Pages      []int       `json:"pages"`
+	Total      int         `json:"total"`
+	Sticky     []apiThread `json:"sticky"`
+	Threads    []apiThread `json:"threads"`
+}
+
+func newAPIPost(p *post) apiPost {
+	out := apiPost{
+		Gid:     p.GlobalId,
+		Lid:     p.LocalId,
+		Thread:  p.ParentThread,
+		ReplyTo: p.ReplyTo,
+		Replies: []postLid{},
+		Time:    p.Time,
+		Comment: p.Comment,
+		Han:     apiHan{p.Han.Char, p.Han.Color, p.Han.Ident},
+		Role:    p.Role.Title,
+	}
+
+	for _, ref := range p.Replies {
+		out.Replies = append(out.Replies, ref.Local)
+	}
+
+	if m := p.Media; m != nil {
+		path := m.Hash + "/" + p.MediaName
+		out.Media = &apiMedia{
+			Hash:   m.Hash,
+			SHA256: m.SHA256,
+			Name:   p.MediaName,
+			Type:   m.MediaType,
+			Info:   m.InfoString,
+			Size:   m.Size,
+			Thumb:  "/th/" + path,
+			Full:   "/i/" + path,
+		}
+	}
+
+	return out
+}
+
+// Summarize thread without its posts.
+func newAPIThreadSummary(t *thread) apiThread {
+	return apiThread{
+		Id:         t.Id,
+		RandomMark: t.RandomMark,
+		Updated:    t.Updated,
+		Tags:       RemoveSpecialLabels(t.Tags),
+		StickyTags: RemoveSpecialLabels(t.StickyTags),
+		Locked:     t.Locked,
+		Nsfw:       t.Nsfw,
+		Count:      t.Count,
+	}
+}
+
+func newAPIThread(t *thread) apiThread {
+	out := newAPIThreadSummary(t)
+	out.Posts = []apiPost{}
+
+	for _, p := range t.Posts {
+		if !p.Hidden {
+			out.Posts = append(out.Posts, newAPIPost(p))
+		}
+	}
+
+	return out
+}
+
+// Summarize query results with the OP of each thread attached.
+func newAPIQuery(normal, sticky []*thread, count int,
+	search parsedQuery) apiQuery {
+
+	summarize := func(threads []*thread) []apiThread {
+		out := []apiThread{}
+		for _, t := range threads {
+			at := newAPIThreadSummary(t)
+			if len(t.Posts) > 0 {
+				at.Posts = []apiPost{newAPIPost(t.Posts[0])}
+			}
+			out = append(out, at)
+		}
+		return out
+	}
+
+	return apiQuery{
+		Merge:      RemoveSpecialLabels(search.Merge),
+		Filter:     RemoveSpecialLabels(search.Filter),
+		Exclude:    RemoveSpecialLabels(search.Exclude),
+		Expression: search.Expression,
+		Sort:       search.Sort,
+		Page:       search.Page,
+		Pages:      pageRange(search.Page, count),
+		Total:      count,
+		Sticky:     summarize(sticky),
+		Threads:    summarize(normal),
+	}
+}
+
+func marshalAPI(v interface{}) []byte {
+	out, e := json.Marshal(v)
+	if e != nil {
+		log.Println(e)
+		return nil
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, content []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(content)
+}
+
+func apiError(w http.ResponseWriter, status int, name string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{name})
+}
+
+// Split request path following the api prefix and endpoint name.
+func apiPathParts(r *http.Request, endpoint string) []string {
+	rest := strings.TrimPrefix(r.URL.Path, apiPrefix+endpoint+"/")
+	return strings.Split(rest, "/")
+}
+
+// /api/v1/cat/<query>[/<page>]
+func showAPIQuery(w http.ResponseWriter, r *http.Request) {
+	parts := apiPathParts(r, "cat")
+	if parts[0] == "" || len(parts) > 2 {
+		apiError(w, http.StatusNotFound, "404")
+		return
+	}
+
+	var page int
+	if len(parts) == 2 {
+		var e error
+		if page, e = strconv.Atoi(parts[1]); e != nil || page < 0 {
+			apiError(w, http.StatusNotFound, "404")
+			return
+		}
+	}
+
+	showTagQuery(page, parts[0], "json")(w, r)
+}
+
+// /api/v1/t/<thread id>
+func showAPIThread(w http.ResponseWriter, r *http.Request) {
+	parts := apiPathParts(r, "t")
+	if len(parts) != 1 || !pageCache.GetThreadJSON(parts[0], w, r) {
+		apiError(w, http.StatusNotFound, "thread_not_exist")
+	}
+}
+
+// /api/v1/p/<global post id>
+func showAPIPost(w http.ResponseWriter, r *http.Request) {
+	parts := apiPathParts(r, "p")
+	if len(parts) != 1 {
+		apiError(w, http.StatusNotFound, "post_not_exist")
+		return
+	}
+
+	gid, e := strconv.ParseUint(parts[0], 10, 64)
+	if e != nil || !pageCache.GetPostJSON(postGid(gid), w, r) {
+		apiError(w, http.StatusNotFound, "post_not_exist")
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// Version of the archive layout, bumped whenever the manifest changes in a
+// way older versions of import can't read.
+const archiveFormat = 1
+
+const archiveManifestName = "manifest.json"
+const archiveMediaDir = "media/"
+
+// Archives are tar files holding a JSON manifest of every database record,
+// followed by the media files named by hash.
+type archiveManifest struct {
+	Format   int
+	Created  time.Time
+	Threads  []archiveThread
+	Posts    []archivePost
+	Media    []archiveMedia
+	Bans     []archiveBan
+	Reports  []archiveReport
+	TagRules []tagRule
+	HasFiles map[string]bool // Hashes of media files present in the archive.
+}
+
+type archiveThread struct {
+	Id         threadId
+	RandomMark uint
+	Updated    time.Time
+	Tags       []string
+	StickyTags []string
+	Locked     bool
+	Hidden     bool
+}
+
+type archivePost struct {
+	Thread       threadId
+	GlobalId     postGid
+	LocalId      postLid
+	ReplyTo      postLid
+	Comment      string
+	UserAddr     string
+	Media        string
+	MediaName    string
+	Time         time.Time
+	Hidden       bool
+	Authority    string
+	NoBump       bool
+	DeleteSecret string
+}
+
+type archiveMedia struct {
+	Hash        string
+	SHA256      string
+	PHash       string
+	ContentType string
+	Thumb       []byte
+	MediaType   string
+	InfoString  string
+	Size        int
+	BanReason   string
+}
+
+type archiveBan struct {
+	Addr        string
+	Reason      string
+	Description string
+	Start       time.Time
+	End         time.Time
+	Revocation  *banRevocation
+	Appeal      *banAppeal
+}
+
+type archiveReport struct {
+	Thread threadId
+	Lid    postLid
+	Queue  string
+	Addr   string
+	Time   time.Time
+}
+
+func newArchiveThread(t *thread) archiveThread {
+	return archiveThread{t.Id, t.RandomMark, t.Updated, t.Tags, t.StickyTags,
+		t.Locked, t.Hidden}
+}
+
+func newArchivePost(p *post) archivePost {
+	ap := archivePost{Thread: p.ParentThread, GlobalId: p.GlobalId,
+		LocalId: p.LocalId, ReplyTo: p.ReplyTo, Comment: p.Comment,
+		UserAddr: p.UserAddr, MediaName: p.MediaName, Time: p.Time,
+		Hidden: p.Hidden, NoBump: p.NoBump, DeleteSecret: p.DeleteSecret}
+
+	if p.Media != nil {
+		ap.Media = p.Media.Hash
+	}
+
+	if p.ShowRole {
+		ap.Authority = p.RoleName
+	}
+
+	return ap
+}
+
+func newArchiveMedia(i *media) archiveMedia {
+	am := archiveMedia{Hash: i.Hash, SHA256: i.SHA256, PHash: i.PHash,
+		ContentType: i.ContentType, Thumb: i.Thumb, MediaType: i.MediaType,
+		InfoString: i.InfoString, Size: i.Size}
+
+	if i.Blocked != nil {
+		am.BanReason = i.Blocked.Name
+	}
+
+	return am
+}
+
+func newArchiveBan(b *userBan) archiveBan {
+	return archiveBan{Addr: b.Addr, Reason: b.Reason.Name,
+		Description: b.Reason.Description, Start: b.Start, End: b.End,
+		Revocation: b.Revocation, Appeal: b.Appeal}
+}
+
+func newArchiveReport(r reportEntry) archiveReport {
+	return archiveReport{r.Thread, r.Lid, r.Queue, r.SubmitterAddr, r.Time}
+}
+
+// `tolxanka export <file>`
+type exportCommand struct {
+	Args struct {
+		File string `positional-arg-name:"archive"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// `tolxanka import <file>`
+type importCommand struct {
+	Args struct {
+		File string `positional-arg-name:"archive"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *exportCommand) Execute(args []string) error {
+	store = initializeDatabase()
+	defer store.Close()
+
+	m, e := readManifest()
+	if e != nil {
+		return e
+	}
+
+	f, e := os.Create(c.Args.File)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	if e := writeArchive(f, m); e != nil {
+		return e
+	}
+
+	log.Printf("Exported %d threads, %d posts and %d media files to %s",
+		len(m.Threads), len(m.Posts), len(m.HasFiles), c.Args.File)
+	return f.Close()
+}
+
+func (c *importCommand) Execute(args []string) error {
+	store = initializeDatabase()
+	defer store.Close()
+
+	empty := true
+	e := store.ReadThreads(func() *thread { return &thread{} },
+		func(*thread) { empty = false })
+	if e != nil {
+		return e
+	}
+
+	if !empty {
+		return errors.New("import requires an empty database")
+	}
+
+	f, e := os.Open(c.Args.File)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	m, e := readArchive(f)
+	if e != nil {
+		return e
+	}
+
+	if e := restoreManifest(m); e != nil {
+		return e
+	}
+
+	log.Printf("Imported %d threads, %d posts and %d media files from %s",
+		len(m.Threads), len(m.Posts), len(m.HasFiles), c.Args.File)
+	return nil
+}
+
+// Collect every stored record into a manifest.
+func readManifest() (*archiveManifest, error) {
+	m := &archiveManifest{
+		Format:   archiveFormat,
+		Created:  time.Now(),
+		HasFiles: map[string]bool{},
+	}
+
+	e := store.ReadThreads(func() *thread { return &thread{} },
+		func(t *thread) {
+			m.Threads = append(m.Threads, newArchiveThread(t))
+		})
+	if e != nil {
+		return nil, e
+	}
+
+	e = store.ReadPosts(func(p *post, mediaHash *string) {
+		if mediaHash != nil {
+			p.Media = &media{Hash: *mediaHash}
+		}
+		p.ShowRole = p.RoleName != ""
+		m.Posts = append(m.Posts, newArchivePost(p))
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	e = store.ReadMedia(func(i *media, reasonName string) {
+		if reasonName != "" {
+			i.Blocked = &banReason{Name: reasonName}
+		}
+		m.Media = append(m.Media, newArchiveMedia(i))
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	bans := map[string]*archiveBan{}
+	banKey := func(addr string, start int64) string {
+		return fmt.Sprintf("%s/%d", addr, start)
+	}
+
+	e = store.ReadBans(func(b *userBan) {
+		m.Bans = append(m.Bans, newArchiveBan(b))
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	for i := range m.Bans {
+		b := &m.Bans[i]
+		bans[banKey(b.Addr, b.Start.Unix())] = b
+	}
+
+	e = store.ReadBanRevocations(
+		func(addr string, start int64, r *banRevocation) {
+			if b, ok := bans[banKey(addr, start)]; ok {
+				b.Revocation = r
+			}
+		})
+	if e != nil {
+		return nil, e
+	}
+
+	e = store.ReadBanAppeals(func(addr string, start int64, a *banAppeal) {
+		if b, ok := bans[banKey(addr, start)]; ok {
+			b.Appeal = a
+		}
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	e = store.ReadReports(func(r reportEntry) {
+		m.Reports = append(m.Reports, newArchiveReport(r))
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	e = store.ReadTagRules(func(r tagRule) {
+		m.TagRules = append(m.TagRules, r)
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	// Blocked media have had their files removed.
+	for _, i := range m.Media {
+		if _, e := os.Stat(mediaPath(i.Hash)); e == nil {
+			m.HasFiles[i.Hash] = true
+		}
+	}
+
+	return m, nil
+}
+
+func mediaPath(hash string) string {
+	return (&media{Hash: hash}).FileName()
+}
+
+func writeArchive(w io.Writer, m *archiveManifest) error {
+	tw := tar.NewWriter(w)
+
+	manifest, e := json.MarshalIndent(m, "", "  ")
+	if e != nil {
+		return e
+	}
+
+	hdr := &tar.Header{
+		Name:    archiveManifestName,
+		Mode:    0644,
+		Size:    int64(len(manifest)),
+		ModTime: m.Created,
+	}
+
+	if e := tw.WriteHeader(hdr); e != nil {
+		return e
+	}
+
+	if _, e := tw.Write(manifest); e != nil {
+		return e
+	}
+
+	for _, i := range m.Media {
+		if m.HasFiles[i.Hash] {
+			if e := writeArchiveFile(tw, i.Hash); e != nil {
+				return e
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeArchiveFile(tw *tar.Writer, hash string) error {
+	f, e := os.Open(mediaPath(hash))
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	info, e := f.Stat()
+	if e != nil {
+		return e
+	}
+
+	hdr := &tar.Header{
+		Name:    archiveMediaDir + hash,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+
+	if e := tw.WriteHeader(hdr); e != nil {
+		return e
+	}
+
+	_, e = io.Copy(tw, f)
+	return e
+}
+
+// Read the manifest and unpack media files into the media directory,
+// verifying each against its hash.
+func readArchive(r io.Reader) (*archiveManifest, error) {
+	tr := tar.NewReader(r)
+
+	hdr, e := tr.Next()
+	if e != nil {
+		return nil, e
+	}
+
+	if hdr.Name != archiveManifestName {
+		return nil, errors.New("archive does not begin with a manifest")
+	}
+
+	m := &archiveManifest{}
+	if e := json.NewDecoder(tr).Decode(m); e != nil {
+		return nil, e
+	}
+
+	if m.Format > archiveFormat {
+		return nil, fmt.Errorf("archive format %d is newer than the latest "+
+			"known format %d", m.Format, archiveFormat)
+	}
+
+	unpacked := map[string]bool{}
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			return nil, e
+		}
+
+		dir, hash := path.Split(hdr.Name)
+		if _, e := hex.DecodeString(hash); e != nil || dir != archiveMediaDir ||
+			!m.HasFiles[hash] {
+			return nil, errors.New("unexpected archive entry: " + hdr.Name)
+		}
+
+		if e := unpackArchiveFile(tr, hash); e != nil {
+			return nil, e
+		}
+		unpacked[hash] = true
+	}
+
+	for hash := range m.HasFiles {
+		if !unpacked[hash] {
+			return nil, errors.New("archive is missing media file " + hash)
+		}
+	}
+
+	return m, nil
+}
+
+func unpackArchiveFile(r io.Reader, hash string) error {
+	tmpName := mediaPath(hash) + ".import"
+	f, e := os.Create(tmpName)
+	if e != nil {
+		return e
+	}
+
+	h := md5.New()
+	_, e = io.Copy(io.MultiWriter(f, h), r)
+	if ce := f.Close(); e == nil {
+		e = ce
+	}
+
+	if e == nil && fmt.Sprintf("%x", h.Sum(nil)) != hash {
+		e = errors.New("hash mismatch for media file " + hash)
+	}
+
+	if e != nil {
+		os.Remove(tmpName)
+		return e
+	}
+
+	return os.Rename(tmpName, mediaPath(hash))
+}
+
+// Write the manifest's records into the database, referenced tables first,
+// in a single transaction.
+func restoreManifest(m *archiveManifest) error {
+	ms := []*media{}
+	for _, am := range m.Media {
+		i := &media{Hash: am.Hash, SHA256: am.SHA256, PHash: am.PHash,
+			ContentType: am.ContentType, Thumb: am.Thumb,
+			MediaType: am.MediaType, InfoString: am.InfoString, Size: am.Size}
+		if am.BanReason != "" {
+			i.Blocked = &banReason{Name: am.BanReason}
+		}
+		ms = append(ms, i)
+	}
+
+	threads := []*thread{}
+	for _, at := range m.Threads {
+		threads = append(threads, &thread{Id: at.Id,
+			RandomMark: at.RandomMark, Updated: at.Updated, Tags: at.Tags,
+			StickyTags: at.StickyTags, Locked: at.Locked, Hidden: at.Hidden})
+	}
+
+	posts := []*post{}
+	for _, ap := range m.Posts {
+		p := &post{ParentThread: ap.Thread, GlobalId: ap.GlobalId,
+			LocalId: ap.LocalId, ReplyTo: ap.ReplyTo, Comment: ap.Comment,
+			UserAddr: ap.UserAddr, MediaName: ap.MediaName, Time: ap.Time,
+			Hidden: ap.Hidden, RoleName: ap.Authority,
+			ShowRole: ap.Authority != "", NoBump: ap.NoBump,
+			DeleteSecret: ap.DeleteSecret}
+		if ap.Media != "" {
+			p.Media = &media{Hash: ap.Media}
+		}
+		posts = append(posts, p)
+	}
+
+	bans := []*userBan{}
+	for _, ab := range m.Bans {
+		bans = append(bans, &userBan{Addr: ab.Addr,
+			Reason: banReason{Name: ab.Reason, Description: ab.Description},
+			Start:  ab.Start, End: ab.End, Revocation: ab.Revocation,
+			Appeal: ab.Appeal})
+	}
+
+	reports := []reportEntry{}
+	for _, ar := range m.Reports {
+		reports = append(reports, reportEntry{ar.Thread, ar.Lid, ar.Queue,
+			report{ar.Addr, ar.Time}})
+	}
+
+	// Any failure, including a single rejected row, rolls back the whole
+	// import.
+	return store.Atomic(func(st storage) error {
+		if e := st.InsertMedia(ms); e != nil {
+			return e
+		}
+
+		if e := st.InsertThreads(threads); e != nil {
+			return e
+		}
+
+		if e := st.InsertPosts(posts); e != nil {
+			return e
+		}
+
+		if e := st.InsertBans(bans); e != nil {
+			return e
+		}
+
+		for _, b := range bans {
+			if b.Revocation != nil {
+				if e := st.InsertBanRevocation(b); e != nil {
+					return e
+				}
+			}
+
+			if b.Appeal != nil {
+				if e := st.InsertBanAppeal(b); e != nil {
+					return e
+				}
+
+				if b.Appeal.Status != "pending" {
+					if e := st.UpdateBanAppeal(b); e != nil {
+						return e
+					}
+				}
+			}
+		}
+
+		for _, r := range m.TagRules {
+			if e := st.InsertTagRule(r); e != nil {
+				return e
+			}
+		}
+
+		return st.InsertReports(reports)
+	})
+}
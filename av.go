@@ -1,12 +1,9 @@
 package main
 
 import (
-	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os/exec"
 	"strconv"
@@ -40,7 +37,9 @@ type probeTags struct {
 
 func ffmpegThumbCmd(fileName string) *exec.Cmd {
 	sec := settings.Video.ThumbnailSeekTime.Duration.Seconds()
-	scale := fmt.Sprintf("scale=w=%d:h=-1", settings.Image.ThumbWidth)
+	scale := fmt.Sprintf("scale=w='min(iw,%d)':h='min(ih,%d)'"+
+		":force_original_aspect_ratio=decrease",
+		settings.Image.ThumbWidth, settings.Image.ThumbHeight)
 
 	return exec.Command(
 		settings.Video.FfmpegPath,
@@ -75,51 +74,34 @@ func startFfmpegWorkers() {
 	}
 }
 
-func (lib *library) InsertVideo(vid io.ReadSeeker) (*media, error) {
-	video, e := ioutil.ReadAll(vid)
-	if e != nil {
-		return nil, e
-	}
-
-	i := new(media)
-
-	i.MediaType = "video"
-	i.Full = video
-	i.Size = len(i.Full)
-	i.InMemory = true
-
-	h := md5.New()
-	h.Write(video)
-	i.Hash = fmt.Sprintf("%x", h.Sum(nil))
-
-	lib.DirectInsert(i)
-
+// Run a job on an ffmpeg worker and wait for it to finish.
+func runFfmpegWork(job func() error) error {
+	var e error
 	wait := make(chan bool)
 	ffmpegWork <- func() {
-		i.InfoString = probeVideo(i.FileName(), i.Size)
-		i.Thumb, _ = webmThumb(i.FileName())
+		e = job()
 		wait <- true
 	}
-
 	<-wait
-	persistMedia <- i
+	return e
+}
 
-	return i, nil
+func processVideo(i *media) error {
+	i.MediaType = "video"
+	return runFfmpegWork(func() error {
+		i.InfoString = probeVideo(i.FileName(), i.Size)
+		i.Thumb, _ = webmThumb(i.FileName())
+		i.PHash, _ = mediaPHash(i)
+		return nil
+	})
 }
 
 func webmThumb(fileName string) ([]byte, error) {
-	cmd := ffmpegThumbCmd(fileName)
-
-	out, e := cmd.StdoutPipe()
+	out, e := ffmpegThumbCmd(fileName).Output()
 	if e != nil {
 		log.Println(e)
 	}
-
-	if e := cmd.Start(); e != nil {
-		log.Println(e)
-	}
-
-	return ioutil.ReadAll(out)
+	return out, e
 }
 
 func probeVideo(fileName string, size int) string {
@@ -177,41 +159,13 @@ func durationString(s string) string {
 	return timeString(int(seconds))
 }
 
-func (lib *library) InsertAudio(aud io.ReadSeeker) (*media, error) {
-	audio, e := ioutil.ReadAll(aud)
-	if e != nil {
-		return nil, e
-	}
-
-	i := new(media)
-
+func processAudio(i *media) error {
 	i.MediaType = "audio"
-	i.Full = audio
-	i.Size = len(i.Full)
-	i.InMemory = true
-
-	h := md5.New()
-	h.Write(audio)
-	i.Hash = fmt.Sprintf("%x", h.Sum(nil))
-
-	lib.DirectInsert(i)
-
-	wait := make(chan bool)
-	ffmpegWork <- func() {
-		i.Thumb = audioThumbnail
-
+	i.Thumb = audioThumbnail
+	return runFfmpegWork(func() (e error) {
 		i.InfoString, e = probeAudio(i.FileName(), i.Size)
-		if e != nil {
-			i = nil
-		}
-
-		wait <- true
-	}
-
-	<-wait
-	persistMedia <- i
-
-	return i, e
+		return e
+	})
 }
 
 func probeAudio(fileName string, size int) (string, error) {
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupPrefix = "persist-"
+const backupSuffix = ".db"
+// Fixed-width nanoseconds keep an on-demand backup from colliding with a
+// scheduled one taken the same second, and names sorting by time.
+const backupTimeFormat = "20060102-150405.000000000"
+
+// Take a consistent copy of the database, then apply retention rules. The
+// dump lock is held throughout so the copy falls between dump ticks.
+func runBackup() (string, error) {
+	dumpMtx.Lock()
+	defer dumpMtx.Unlock()
+
+	dir := settings.Backup.Directory
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return "", e
+	}
+
+	name := backupPrefix + time.Now().Format(backupTimeFormat) + backupSuffix
+	dest := filepath.Join(dir, name)
+	if e := store.Backup(dest); e != nil {
+		return "", e
+	}
+
+	pruneBackups(dir)
+	return dest, nil
+}
+
+// Remove backups beyond the newest Keep, and any older than MaxAge. Either
+// rule is disabled when zero.
+func pruneBackups(dir string) {
+	files, e := ioutil.ReadDir(dir)
+	if e != nil {
+		log.Println(e)
+		return
+	}
+
+	backups := []os.FileInfo{}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, backupPrefix) &&
+			strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, f)
+		}
+	}
+
+	// Names sort by creation time; newest first.
+	sort.Sort(sort.Reverse(backupsByName(backups)))
+
+	keep := settings.Backup.Keep
+	maxAge := settings.Backup.MaxAge.Duration
+	for i, f := range backups {
+		expired := maxAge > 0 && time.Since(f.ModTime()) > maxAge
+		if (keep > 0 && i >= keep) || expired {
+			log.Println("Removing old backup " + f.Name())
+			if e := os.Remove(filepath.Join(dir, f.Name())); e != nil {
+				log.Println(e)
+			}
+		}
+	}
+}
+
+type backupsByName []os.FileInfo
+
+func (b backupsByName) Len() int           { return len(b) }
+func (b backupsByName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b backupsByName) Less(i, j int) bool { return b[i].Name() < b[j].Name() }
+
+func initBackupScheduler() {
+	if settings.Backup.Interval.Duration <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(settings.Backup.Interval.Duration)
+	go func() {
+		for {
+			<-ticker.C
+			if dest, e := runBackup(); e != nil {
+				log.Println("Scheduled backup failed: " + e.Error())
+			} else {
+				log.Println("Scheduled backup written to " + dest)
+			}
+		}
+	}()
+}
+
+func postBackup(w http.ResponseWriter, r *http.Request) {
+	if !getStaffRole(r).RunBackups {
+		return
+	}
+
+	log.Printf("%s requested a database backup", getStaffName(r))
+	dest, e := runBackup()
+	if e != nil {
+		log.Println("Backup failed: " + e.Error())
+		msg(w, 200, "backup_failed")
+		return
+	}
+
+	log.Println("Backup written to " + dest)
+	passthrough(w, "backup_complete", "/")
+}
@@ -12,11 +12,16 @@ import (
 	"strings"
 )
 
+// Form data held in memory while parsing a post. Uploads beyond this are
+// spooled to temporary files instead.
+const uploadMemory = 1 << 20
+
 func storeImage(r *http.Request) (string, *media, error) {
 	file, header, e := r.FormFile("upload")
 	if e != nil {
 		return "", nil, nil
 	}
+	defer file.Close()
 	fileFormat := header.Header.Get("Content-Type")
 
 	if !isValidFormat(fileFormat) {
@@ -71,7 +76,7 @@ func postThread(w http.ResponseWriter, r *http.Request) {
 	}
 
 	r.Body = http.MaxBytesReader(w, r.Body, settings.General.maxFileSize)
-	r.ParseMultipartForm(settings.General.maxFileSize)
+	r.ParseMultipartForm(uploadMemory)
 
 	if normalizePostFields(r) != nil {
 		msg(w, http.StatusOK, "invalid_fields")
@@ -100,7 +105,7 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	r.Body = http.MaxBytesReader(w, r.Body, settings.General.maxFileSize)
-	r.ParseMultipartForm(settings.General.maxFileSize)
+	r.ParseMultipartForm(uploadMemory)
 
 	if normalizePostFields(r) != nil {
 		msg(w, http.StatusOK, "invalid_fields")
@@ -145,6 +150,10 @@ func recordPost(w http.ResponseWriter, r *http.Request, p *post) {
 		return
 	}
 
+	// With SimilarAction = "reject", similar media came back blocked above.
+	review := img != nil && settings.Media.SimilarAction == "review" &&
+		mediaStore.SimilarBlocked(img) != nil
+
 	uid, e := strconv.ParseUint(r.Form.Get("user_num"), 10, 64)
 	if e != nil {
 		msg(w, http.StatusNotFound, "unable_to_post")
@@ -156,6 +165,7 @@ func recordPost(w http.ResponseWriter, r *http.Request, p *post) {
 		p.ReplyTo = postLid(target)
 	}
 
+	p.NoBump = r.Form.Get("no_bump") == "on"
 	p.Comment = r.Form.Get("comment")
 	if p.Comment == "" && img == nil {
 		msg(w, http.StatusNotFound, "need_pic_or_text")
@@ -166,6 +176,11 @@ func recordPost(w http.ResponseWriter, r *http.Request, p *post) {
 	p.Media = img
 	p.MediaName = imgName
 	p.DesiredUserId = uid
+	if p.DeleteSecret, e = secureToken(32); e != nil {
+		log.Println("Could not generate deletion secret: " + e.Error())
+		msg(w, http.StatusOK, "unable_to_post")
+		return
+	}
 
 	hiveReq(func(h *hive) {
 		pr, err := h.AddPost(p)
@@ -174,6 +189,19 @@ func recordPost(w http.ResponseWriter, r *http.Request, p *post) {
 			return
 		}
 
+		if review {
+			h.QueueMediaReview(p)
+		}
+
+		if window := settings.Limit.DeleteWindow.Duration; window > 0 {
+			http.SetCookie(w, &http.Cookie{
+				Name:   fmt.Sprintf("delete_%d", p.GlobalId),
+				Value:  p.DeleteSecret,
+				Path:   "/",
+				MaxAge: int(window.Seconds()),
+			})
+		}
+
 		// Don't redirect xmlHttpRequest.
 		if r.Form.Get("no_redirect") == "" {
 			threadUrl := fmt.Sprintf("t/%s#%d", pr.Thread, pr.Local)
@@ -195,7 +223,7 @@ func showFullMedia(w http.ResponseWriter, r *http.Request) {
 	hash := parts[2]
 	vals := "max-age=360, public, must-revalidate, proxy-revalidate"
 	w.Header().Add("Cache-Control", vals)
-	mediaStore.WriteMedia(w, hash, true)
+	mediaStore.WriteMedia(w, r, hash, true)
 }
 
 func showRobots(w http.ResponseWriter, r *http.Request) {
@@ -210,15 +238,18 @@ func showThumbImage(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 	hash := parts[2]
 
-	vals := "max-age=315360000, public, must-revalidate, proxy-revalidate"
+	// Thumbnails can be rebuilt, so caches revalidate them daily.
+	vals := "max-age=86400, public, must-revalidate, proxy-revalidate"
 	w.Header().Add("Cache-Control", vals)
-	mediaStore.WriteMedia(w, hash, false)
+	mediaStore.WriteMedia(w, r, hash, false)
 }
 
 // Registers the websocket under the thread's listeners. When
 // the handler exits the websocket is automatically closed, so
 // to stop this the handler blocks on a channel waiting for
 // notification that the thread is no longer broadcasting.
+// Clients passing "?protocol=events" receive JSON event envelopes;
+// others receive raw post HTML.
 func threadUpdater(ws *websocket.Conn) {
 	r := ws.Request()
 	parts := strings.Split(r.URL.Path, "/")
@@ -226,8 +257,12 @@ func threadUpdater(ws *websocket.Conn) {
 		return
 	}
 
-	reg := wsRegistration{threadId(parts[2]), make(chan bool, 1), ws}
+	events := r.URL.Query().Get("protocol") == "events"
+	reg := newWsRegistration(threadId(parts[2]), ws, events)
 	regListener <- reg
+
+	go reg.writeLoop()
+	go reg.readLoop()
 	<-reg.Done
 }
 
@@ -237,6 +272,7 @@ func showTagQuery(page int, query, view string) http.HandlerFunc {
 
 		var search parsedQuery
 		search.QueryString = query
+		search.BaseURL = "http://" + r.Host
 		search.Page = page
 		search.WriteOut = w
 		search.View = view
@@ -245,30 +281,56 @@ func showTagQuery(page int, query, view string) http.HandlerFunc {
 			search.Admin = true
 		}
 
-		isBadAdminTagQuery := func(term string) bool {
-			return strings.HasPrefix(term, "!?_") && !search.Admin
+		search.Sort = r.FormValue("sort")
+		if search.Sort == "" {
+			search.Sort = "bump"
+		} else if !validThreadOrder(search.Sort) {
+			queryError(w, view,
+				fmt.Errorf("unknown sort order %q", search.Sort))
+			return
+		}
+
+		allowTag := func(tag string) error {
+			if strings.HasPrefix(tag, "!?_") && !search.Admin {
+				return fmt.Errorf("tag %q is restricted", tag)
+			}
+			return nil
 		}
 
+		tagTerms := []string{}
 		for _, term := range terms {
-			switch term[0] {
-			case '-':
-				if len(term) > 1 && !isBadAdminTagQuery(term[1:]) {
-					search.Exclude = append(search.Exclude, term[1:])
-				}
-			case '+':
-				if len(term) > 1 && !isBadAdminTagQuery(term[1:]) {
-					search.Merge = append(search.Merge, term[1:])
-				}
-			default:
-				if !isBadAdminTagQuery(term) {
-					search.Filter = append(search.Filter, term)
-				}
+			if strings.HasPrefix(term, "q:") {
+				search.Comment = append(search.Comment,
+					commentWords(term[2:])...)
+				continue
 			}
+			tagTerms = append(tagTerms, term)
+		}
+
+		expr, e := parseTagQuery(strings.Join(tagTerms, " "), allowTag)
+		if e != nil {
+			queryError(w, view, e)
+			return
+		}
+
+		// Simple queries are shown as their filtered, merged and excluded
+		// tags; anything with grouping or OR is shown as an expression.
+		if se, ok := expr.(*seqExpr); ok && se.isPlain() {
+			search.Filter, search.Merge, search.Exclude = se.plainTags()
+		} else if expr != nil {
+			search.Expression = expr.String()
+		}
+
+		// A comment search alone looks through every thread.
+		search.Expr = expr
+		if expr == nil && len(search.Comment) > 0 {
+			search.Expr = &seqExpr{}
 		}
 
 		nsfw, e := r.Cookie("show_nsfw")
 		if e != nil || nsfw.Value != "true" {
 			search.Exclude = append(search.Exclude, "!!_nsfw")
+			search.Expr = excludeTag(search.Expr, "!!_nsfw")
 		}
 
 		hiveReq(func(h *hive) {
@@ -420,10 +482,83 @@ func postReport(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Delete a post on behalf of its poster, who proves ownership with the
+// secret cookie issued when the post was made.
+func postDeleteOwnPost(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	gid, e := strconv.ParseUint(r.Form.Get("gid"), 10, 64)
+	if e != nil {
+		msg(w, http.StatusOK, "invalid_fields")
+		return
+	}
+
+	secret, e := r.Cookie(fmt.Sprintf("delete_%d", gid))
+	if e != nil {
+		msg(w, http.StatusOK, "not_post_owner")
+		return
+	}
+
+	var tid threadId
+	hiveReq(func(h *hive) {
+		tid, e = h.DeleteOwnPost(postGid(gid), secret.Value)
+	})
+
+	if e != nil {
+		msg(w, http.StatusOK, e.Error())
+	} else if r.Form.Get("no_redirect") == "" {
+		passthrough(w, "post_deleted", "/t/"+string(tid))
+	}
+}
+
+// Banned users may submit a single appeal per ban from the banned page.
+func postBanAppeal(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ip := strings.SplitN(r.RemoteAddr, ":", 2)[0]
+	text := strings.TrimSpace(r.Form.Get("appeal"))
+
+	if text == "" {
+		msg(w, http.StatusOK, "invalid_fields")
+		return
+	}
+
+	if len(text) > settings.Limit.CommentLength {
+		msg(w, http.StatusOK, "comment_too_long")
+		return
+	}
+
+	ban, e := siteUsers.AppealBan(ip, text)
+	if e != nil {
+		msg(w, http.StatusOK, e.Error())
+		return
+	}
+
+	hiveReq(func(h *hive) {
+		h.QueueAppeal(ban)
+	})
+
+	passthrough(w, "appeal_submitted", "/")
+}
+
 func getAutocomplete(w http.ResponseWriter, r *http.Request) {
 	tagSearch.WriteList(w)
 }
 
+// Report a malformed tag query or sort order in the format of the requested
+// view.
+func queryError(w http.ResponseWriter, view string, e error) {
+	text := "Malformed query: " + e.Error()
+
+	switch view {
+	case "json":
+		apiError(w, http.StatusBadRequest, text)
+	case "atom":
+		http.Error(w, text, http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		templates.ExecuteTemplate(w, "msg", text)
+	}
+}
+
 func msg(w http.ResponseWriter, status int, msgName string) {
 	w.WriteHeader(status)
 	templates.ExecuteTemplate(w, msgName, nil)
@@ -9,19 +9,26 @@ var pageCache *byteCache
 
 // cached limited-lifetime raw page data for page 0 indifidual tag queries.
 type byteCache struct {
-	pages map[string]*bPage
-	mtx   sync.RWMutex
+	pages       map[string]*bPage
+	postThreads map[postGid]threadId
+	mtx         sync.RWMutex
 }
 
+// Templated thread page along with its JSON representations. All of them
+// are dropped together whenever the thread is marked stale.
 type bPage struct {
-	Content []byte
-	Hidden  bool
-	Fresh   bool
+	Content   []byte
+	JSON      []byte
+	PostJSON  map[postGid][]byte
+	Hidden    bool
+	Fresh     bool
+	FreshJSON bool
 }
 
 func newByteCache() *byteCache {
 	c := new(byteCache)
 	c.pages = map[string]*bPage{}
+	c.postThreads = map[postGid]threadId{}
 	return c
 }
 
@@ -29,14 +36,24 @@ func (c *byteCache) SetStale(title string, hide bool) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	c.pages[title] = &bPage{[]byte{}, hide, false}
+	c.pages[title] = &bPage{
+		Content:  []byte{},
+		PostJSON: map[postGid][]byte{},
+		Hidden:   hide,
+	}
 }
 
+// Drop a deleted thread's page, along with the lookups for its posts.
 func (c *byteCache) Purge(title string) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
 	delete(c.pages, title)
+	for gid, tid := range c.postThreads {
+		if string(tid) == title {
+			delete(c.postThreads, gid)
+		}
+	}
 }
 
 // send page from cache. If necessary, validate admin credentials first. If
@@ -72,8 +89,113 @@ func (c *byteCache) Get(title string,
 	return true
 }
 
+// send JSON representation of a thread from cache, regenerating it from the
+// hive if stale.
+func (c *byteCache) GetThreadJSON(title string,
+	w http.ResponseWriter, r *http.Request) bool {
+
+	c.mtx.RLock()
+	bp, ok := c.pages[title]
+	if !ok || (bp.Hidden && !getStaffRole(r).SeeHiddenThreads) {
+		c.mtx.RUnlock()
+		return false
+	}
+	content, fresh := bp.JSON, bp.FreshJSON
+	c.mtx.RUnlock()
+
+	if !fresh {
+		content = sendThreadJSONRequest(threadId(title))
+		if content == nil {
+			return false
+		}
+
+		c.mtx.Lock()
+		if c.pages[title] == bp {
+			bp.JSON = content
+			bp.FreshJSON = true
+		}
+		c.mtx.Unlock()
+	}
+
+	writeJSON(w, content)
+	return true
+}
+
+// send JSON representation of a single post from cache. Posts are cached
+// under their parent thread's page so that they go stale with it.
+func (c *byteCache) GetPostJSON(gid postGid,
+	w http.ResponseWriter, r *http.Request) bool {
+
+	c.mtx.RLock()
+	tid, known := c.postThreads[gid]
+	bp, ok := c.pages[string(tid)]
+	var content []byte
+	if known && ok {
+		if bp.Hidden && !getStaffRole(r).SeeHiddenThreads {
+			c.mtx.RUnlock()
+			return false
+		}
+		content = bp.PostJSON[gid]
+	}
+	c.mtx.RUnlock()
+
+	if content != nil {
+		writeJSON(w, content)
+		return true
+	}
+
+	var hidden bool
+	tid, hidden, content = sendPostJSONRequest(gid)
+	if content == nil || (hidden && !getStaffRole(r).SeeHiddenThreads) {
+		return false
+	}
+
+	c.mtx.Lock()
+	c.postThreads[gid] = tid
+	if bp, ok := c.pages[string(tid)]; ok {
+		bp.PostJSON[gid] = content
+	}
+	c.mtx.Unlock()
+
+	writeJSON(w, content)
+	return true
+}
+
 func sendPageRequest(title string) []byte {
 	reply := make(chan []byte, 1)
 	threadRequest <- threadReq{threadId(title), reply}
 	return <-reply
 }
+
+func sendThreadJSONRequest(tid threadId) []byte {
+	var out []byte
+	hiveReq(func(h *hive) {
+		if t, ok := h.Threads[tid]; ok {
+			out = marshalAPI(newAPIThread(t))
+		}
+	})
+	return out
+}
+
+func sendPostJSONRequest(gid postGid) (threadId, bool, []byte) {
+	var tid threadId
+	var hidden bool
+	var out []byte
+
+	hiveReq(func(h *hive) {
+		p := h.GetPost(gid)
+		if p == nil || p.Hidden || p.NoDump {
+			return
+		}
+
+		t, ok := h.Threads[p.ParentThread]
+		if !ok {
+			return
+		}
+
+		tid, hidden = t.Id, t.Hidden
+		out = marshalAPI(newAPIPost(p))
+	})
+
+	return tid, hidden, out
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/nfnt/resize"
 	"io/ioutil"
 	"log"
 	"path/filepath"
@@ -26,6 +27,8 @@ type tolxankaConfigToml struct {
 	SpamTrap spamTrapConf
 	Notify   notifyConf
 	Database dbConf
+	Sockets  socketConf
+	Backup   backupConf
 
 	Staff       map[string]Staff
 	Roles       map[string]Role
@@ -45,23 +48,27 @@ type generalConf struct {
 	AutoDeleteThreshold   int
 	PostTimeFormat        string
 	SummaryPostTailLength int
+	ShutdownTimeout       duration
 
 	maxFileSize int64
 }
 
 type catalogConf struct {
-	SummaryCharLimit int
-	PageRange        int
-	ThreadsPerPage   int
+	SummaryCharLimit     int
+	PageRange            int
+	ThreadsPerPage       int
+	TagDirectoryLifetime duration
 }
 
 type limitConf struct {
 	Threads         int
 	PostsPerThread  int
+	BumpLimit       int
 	TagsPerThread   int
 	CommentLength   int
 	TagLength       int
 	NewlinesPerPost int
+	DeleteWindow    duration
 }
 
 type adminConf struct {
@@ -72,16 +79,20 @@ type adminConf struct {
 }
 
 type mediaConf struct {
-	Path          string
-	ValidReferers []string
-	CacheSize     int
+	Path            string
+	ValidReferers   []string
+	SimilarDistance int
+	SimilarAction   string
 }
 
 type imageConf struct {
 	AcceptedFileFormats []string
 	ThumbWidth          int
 	ThumbHeight         int
+	ThumbFilter         string
 	MaxSize             int64
+
+	thumbFilter resize.InterpolationFunction
 }
 
 type videoConf struct {
@@ -115,13 +126,32 @@ type notifyConf struct {
 	FromEmail  string
 }
 
+type socketConf struct {
+	QueueSize    int
+	PingInterval duration
+	PongWait     duration
+	WriteTimeout duration
+}
+
+type backupConf struct {
+	Directory string
+	Interval  duration
+	Keep      int
+	MaxAge    duration
+}
+
 type dbConf struct {
+	Backend         string
 	Name            string
 	DumpInterval    duration
 	BanQueueSize    int
 	PostQueueSize   int
 	ThreadQueueSize int
 	MediaQueueSize  int
+	StateQueueSize  int
+	DumpRetries     int
+	RetryBackoff    duration
+	DeadLetterFile  string
 }
 
 type Role struct {
@@ -138,6 +168,9 @@ type Role struct {
 	DeleteThread         bool
 	DeletePost           bool
 	BanUser              bool
+	ManageBans           bool
+	RunBackups           bool
+	ManageTags           bool
 	BlockImage           bool
 	ShowUserPosts        bool
 	RecommendBan         bool
@@ -210,7 +243,8 @@ func readConfigToml(path string) *tolxankaConfigToml {
 	raw := concatenateToml(path)
 	cfg := &tolxankaConfigToml{}
 
-	if e := toml.Unmarshal(raw, cfg); e != nil {
+	md, e := toml.Decode(string(raw), cfg)
+	if e != nil {
 		panic(e)
 	}
 
@@ -223,13 +257,19 @@ func readConfigToml(path string) *tolxankaConfigToml {
 		cfg.BanReasons[k] = v
 	}
 
-	var e error
+	cfg.setDefaults(md)
+
+	filter, ok := thumbFilters[cfg.Image.ThumbFilter]
+	if !ok {
+		log.Panic("Unknown thumbnail filter: " + cfg.Image.ThumbFilter)
+	}
+	cfg.Image.thumbFilter = filter
+
 	audioThumbnail, e = ioutil.ReadFile(cfg.Audio.ThumbnailFile)
 	if e != nil {
 		log.Panic(e)
 	}
 
-	cfg.Media.CacheSize *= (1000 * 1000)
 	cfg.Image.MaxSize *= (1000 * 1000)
 	cfg.Video.MaxSize *= (1000 * 1000)
 	cfg.Audio.MaxSize *= (1000 * 1000)
@@ -239,6 +279,46 @@ func readConfigToml(path string) *tolxankaConfigToml {
 	return cfg
 }
 
+// Fill in settings which older configuration files lack, or which would
+// break the board if left at zero. Settings where zero is meaningful are
+// only filled in when missing.
+func (cfg *tolxankaConfigToml) setDefaults(md toml.MetaData) {
+	if cfg.Sockets.QueueSize < 1 {
+		cfg.Sockets.QueueSize = 64
+	}
+	defaultDuration(&cfg.Sockets.PingInterval, 30*time.Second)
+	defaultDuration(&cfg.Sockets.PongWait, 75*time.Second)
+	defaultDuration(&cfg.Sockets.WriteTimeout, 10*time.Second)
+	defaultDuration(&cfg.General.ShutdownTimeout, 30*time.Second)
+	if !md.IsDefined("Catalog", "TagDirectoryLifetime") {
+		cfg.Catalog.TagDirectoryLifetime.Duration = time.Minute
+	}
+	if cfg.Image.ThumbFilter == "" {
+		cfg.Image.ThumbFilter = "lanczos3"
+	}
+	if !md.IsDefined("Database", "StateQueueSize") {
+		cfg.Database.StateQueueSize = 1000
+	}
+	if !md.IsDefined("Database", "DumpRetries") {
+		cfg.Database.DumpRetries = 3
+	}
+	if !md.IsDefined("Database", "RetryBackoff") {
+		cfg.Database.RetryBackoff.Duration = 500 * time.Millisecond
+	}
+	if cfg.Database.DeadLetterFile == "" {
+		cfg.Database.DeadLetterFile = "deadletter.jsonl"
+	}
+	if cfg.Backup.Directory == "" {
+		cfg.Backup.Directory = "backups"
+	}
+}
+
+func defaultDuration(dur *duration, value time.Duration) {
+	if dur.Duration <= 0 {
+		dur.Duration = value
+	}
+}
+
 func max(nums ...int64) int64 {
 	maximum := nums[0]
 	for _, n := range nums {
@@ -1,10 +1,13 @@
 package main
 
 import (
-	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
+	"encoding/json"
+	"errors"
 	"log"
-	"strings"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,228 +15,306 @@ var persistBan chan *userBan
 var persistPost chan *post
 var persistThread chan *thread
 var persistMedia chan *media
-var sqlInsertThread, sqlInsertPost, sqlInsertMedia, sqlInsertBan *sql.Stmt
-
-func prepareStatements(db *sql.DB) {
-	prepare := func(cmd string) *sql.Stmt {
-		if stmt, e := db.Prepare(cmd); e != nil {
-			panic(e)
-		} else {
-			return stmt
-		}
+var persistPostState chan postState
+var persistThreadState chan threadState
+var persistReport chan reportEntry
+var dumpMtx sync.Mutex
+
+// Moderation state of a post or thread at the time of the change. Posts are
+// identified by thread and local id, since global ids are reassigned on
+// recovery.
+type postState struct {
+	Thread threadId
+	Lid    postLid
+	Hidden bool
+}
+
+type threadState struct {
+	Id     threadId
+	Locked bool
+	Hidden bool
+}
+
+// A single report against a post, filed under the name of its report queue.
+type reportEntry struct {
+	Thread threadId
+	Lid    postLid
+	Queue  string
+	report
+}
+
+func initializeDatabase() storage {
+	s, e := openStorage(settings.Database)
+	if e != nil {
+		log.Fatal("Could not open database: " + e.Error())
 	}
+	return s
+}
 
-	sqlInsertThread = prepare(
-		"INSERT INTO threads " +
-			"(id, random_mark, updated, tags, sticky_tags, locked, hidden) " +
-			"VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7);")
-
-	sqlInsertPost = prepare(
-		"INSERT INTO posts " +
-			"(comment, user_addr, media, media_name, global_id, local_id, reply_to, " +
-			"time, parent_thread, hidden, authority) " +
-			"VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11);")
-
-	sqlInsertMedia = prepare(
-		"INSERT INTO media " +
-			"(hash, thumb, type, info, size, ban_reason) " +
-			"VALUES (?1, ?2, ?3, ?4, ?5, ?6);")
-
-	sqlInsertBan = prepare(
-		"INSERT INTO bans " +
-			"(user_addr, reason, description, start_time, end_time) " +
-			"VALUES (?1, ?2, ?3, ?4, ?5);")
+// Counters for the dump loop, shown to staff at /admin_db_stats.
+var dumpStats struct {
+	Retries      int64 // Batches retried after a failed transaction.
+	Failures     int64 // Batches abandoned after exhausting retries.
+	DeadLettered int64 // Records written to the dead-letter file.
+	Rejected     int64 // Posts refused because the post queue was full.
 }
 
-func createSchema(db *sql.DB) {
-	run := func(cmd string) {
-		if _, e := db.Exec(cmd); e != nil {
-			panic(e)
+// Write a batch, retrying with exponential backoff when the transaction
+// fails. Rows the database rejects, and whole batches that still fail after
+// DumpRetries attempts, are sent to the dead-letter file.
+func persistBatch(kind string, n int, write func() error,
+	record func(i int) interface{}) {
+
+	if n == 0 {
+		return
+	}
+
+	backoff := settings.Database.RetryBackoff.Duration
+	for attempt := 0; ; attempt++ {
+		e := write()
+		if e == nil {
+			return
 		}
+
+		if be, ok := e.(*batchError); ok {
+			for i, rowErr := range be.Failed {
+				writeDeadLetter(kind, record(i), rowErr)
+			}
+			return
+		}
+
+		if attempt >= settings.Database.DumpRetries {
+			log.Printf("Giving up on batch of %d %s records: %s", n, kind,
+				e.Error())
+			atomic.AddInt64(&dumpStats.Failures, 1)
+			for i := 0; i < n; i++ {
+				writeDeadLetter(kind, record(i), e)
+			}
+			return
+		}
+
+		log.Printf("Writing %s batch failed, retrying in %v: %s", kind,
+			backoff, e.Error())
+		atomic.AddInt64(&dumpStats.Retries, 1)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+}
 
-	run(`CREATE TABLE IF NOT EXISTS threads(
-                id              TEXT PRIMARY KEY,
-                random_mark     INTEGER NOT NULL,
-                updated         INTEGER NOT NULL,
-                tags            TEXT NOT NULL,
-                sticky_tags     TEXT NOT NULL,
-                locked          INTEGER NOT NULL,
-                hidden          INTEGER NOT NULL);`)
-
-	run(`CREATE TABLE IF NOT EXISTS posts(
-                id              INTEGER PRIMARY KEY,
-                comment         TEXT NOT NULL,
-                user_addr       TEXT NOT NULL,
-                media           TEXT REFERENCES media(hash),
-                media_name      TEXT NOT NULL,
-                global_id       INTEGER NOT NULL,
-                local_id        INTEGER NOT NULL,
-                reply_to        INTEGER NOT NULL,
-                time            INTEGER NOT NULL,
-                parent_thread   TEXT REFERENCES threads(id) ON DELETE CASCADE,
-                hidden          INTEGER NOT NULL,
-                authority       TEXT NOT NULL);`)
-
-	run(`CREATE TABLE IF NOT EXISTS media(
-                hash            TEXT PRIMARY KEY,
-                thumb           TEXT NOT NULL,
-                type            TEXT NOT NULL,
-                info            TEXT NOT NULL,
-                size            INTEGER NOT NULL,
-                ban_reason      TEXT NOT NULL);`)
-
-	run(`CREATE TABLE IF NOT EXISTS bans(
-                id              INTEGER PRIMARY KEY,
-                user_addr       TEXT NOT NULL,
-                reason          TEXT NOT NULL,
-                description     TEXT NOT NULL,
-                start_time      INTEGER NOT NULL,
-                end_time        INTEGER NOT NULL);`)
+// A record which could not be persisted, as written to the dead-letter file.
+type deadLetter struct {
+	Time   time.Time
+	Kind   string
+	Error  string
+	Record interface{}
 }
 
-func initializeDatabase() *sql.DB {
-	var e error
-	db, e := sql.Open("sqlite3", settings.Database.Name)
+var deadLetterMtx sync.Mutex
+
+// Append a record to the dead-letter file as a line of JSON. If even that
+// fails, the record goes to the log so it isn't lost entirely.
+func writeDeadLetter(kind string, record interface{}, cause error) {
+	atomic.AddInt64(&dumpStats.DeadLettered, 1)
+	line, e := json.Marshal(deadLetter{time.Now(), kind, cause.Error(), record})
 	if e != nil {
-		panic(e)
+		log.Printf("Could not encode dead %s record: %s", kind, e.Error())
+		return
 	}
 
-	if _, e := db.Exec("PRAGMA foreign_keys = ON;"); e != nil {
-		log.Panic(e)
+	deadLetterMtx.Lock()
+	defer deadLetterMtx.Unlock()
+
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	f, e := os.OpenFile(settings.Database.DeadLetterFile, flags, 0600)
+	if e == nil {
+		_, e = f.Write(append(line, '\n'))
+		if ce := f.Close(); e == nil {
+			e = ce
+		}
 	}
 
-	createSchema(db)
-	prepareStatements(db)
-	return db
+	if e != nil {
+		log.Printf("Could not write dead-letter file (%s); lost record: %s",
+			e.Error(), line)
+	}
 }
 
-func dbInsertThread(tx *sql.Tx, t *thread) (sql.Result, error) {
-	return tx.Stmt(sqlInsertThread).Exec(
-		string(t.Id), t.RandomMark, t.Updated.Unix(),
-		strings.Join(t.Tags, " "), strings.Join(t.StickyTags, " "),
-		t.Locked, t.Hidden)
+func dumpThreads(threads chan *thread) {
+	batch := []*thread{}
+	for len(threads) != 0 {
+		batch = append(batch, <-threads)
+	}
+
+	persistBatch("thread", len(batch),
+		func() error { return store.InsertThreads(batch) },
+		func(i int) interface{} { return newArchiveThread(batch[i]) })
 }
 
-func dbInsertPost(tx *sql.Tx, p *post) (sql.Result, error) {
-	var imgHash *string
-	var role string
+func dumpPosts(posts chan *post) {
+	batch := []*post{}
+	for len(posts) != 0 {
+		batch = append(batch, <-posts)
+	}
 
-	if p.Media != nil {
-		imgHash = &p.Media.Hash
+	persistBatch("post", len(batch),
+		func() error { return store.InsertPosts(batch) },
+		func(i int) interface{} { return newArchivePost(batch[i]) })
+}
+
+func dumpMedia(ms chan *media) {
+	batch := []*media{}
+	for len(ms) != 0 {
+		batch = append(batch, <-ms)
 	}
 
-	if p.ShowRole {
-		role = p.RoleName
+	persistBatch("media", len(batch),
+		func() error { return store.InsertMedia(batch) },
+		func(i int) interface{} { return newArchiveMedia(batch[i]) })
+}
+
+func dumpBans(bans chan *userBan) {
+	batch := []*userBan{}
+	for len(bans) != 0 {
+		batch = append(batch, <-bans)
 	}
 
-	return tx.Stmt(sqlInsertPost).Exec(
-		p.Comment, p.UserAddr, imgHash, p.MediaName, p.GlobalId, p.LocalId,
-		p.ReplyTo, p.Time.Unix(), string(p.ParentThread), p.Hidden, role)
+	persistBatch("ban", len(batch),
+		func() error { return store.InsertBans(batch) },
+		func(i int) interface{} { return newArchiveBan(batch[i]) })
 }
 
-func dbInsertMedia(tx *sql.Tx, i *media) (sql.Result, error) {
-	var banReason string
-	if i.Blocked != nil {
-		banReason = i.Blocked.Name
+func dumpThreadStates(states chan threadState) {
+	batch := []threadState{}
+	for len(states) != 0 {
+		batch = append(batch, <-states)
 	}
 
-	return tx.Stmt(sqlInsertMedia).Exec(i.Hash, i.Thumb, i.MediaType,
-		i.InfoString, i.Size, banReason)
+	persistBatch("thread_state", len(batch),
+		func() error { return store.UpdateThreadStates(batch) },
+		func(i int) interface{} { return batch[i] })
 }
 
-func dbInsertBan(tx *sql.Tx, b *userBan) (sql.Result, error) {
-	return tx.Stmt(sqlInsertBan).Exec(b.Addr, b.Reason.Name,
-		b.Reason.Description, b.Start.Unix(), b.End.Unix())
+func dumpPostStates(states chan postState) {
+	batch := []postState{}
+	for len(states) != 0 {
+		batch = append(batch, <-states)
+	}
+
+	persistBatch("post_state", len(batch),
+		func() error { return store.UpdatePostStates(batch) },
+		func(i int) interface{} { return batch[i] })
 }
 
-func dumpBans(bans chan *userBan) {
-	wrapTransaction(db, func(tx *sql.Tx) {
-		for len(bans) != 0 {
-			if _, e := dbInsertBan(tx, <-bans); e != nil {
-				log.Println(e)
-			}
-		}
-	})
+func dumpReports(reports chan reportEntry) {
+	batch := []reportEntry{}
+	for len(reports) != 0 {
+		batch = append(batch, <-reports)
+	}
+
+	persistBatch("report", len(batch),
+		func() error { return store.InsertReports(batch) },
+		func(i int) interface{} { return newArchiveReport(batch[i]) })
 }
 
-func dumpPosts(posts chan *post) {
-	wrapTransaction(db, func(tx *sql.Tx) {
-		for len(posts) != 0 {
-			if _, e := dbInsertPost(tx, <-posts); e != nil {
-				log.Println(e)
-			}
-		}
-	})
+// Whether the post queues can take another post, and its thread if it
+// starts one. Only the hive sends to these queues, so the answer holds
+// until the hive's next send.
+func persistRoom(newThread bool) bool {
+	if len(persistPost) >= cap(persistPost) {
+		return false
+	}
+	return !newThread || len(persistThread) < cap(persistThread)
 }
 
-func dumpThreads(threads chan *thread) {
-	wrapTransaction(db, func(tx *sql.Tx) {
-		for len(threads) != 0 {
-			if _, e := dbInsertThread(tx, <-threads); e != nil {
-				log.Println(e)
-			}
-		}
-	})
+// Moderation changes and bans are queued without blocking the hive or the
+// request issuing them. If their queue is full, they go straight to the
+// dead-letter file.
+func queueBan(b *userBan) {
+	select {
+	case persistBan <- b:
+	default:
+		writeDeadLetter("ban", newArchiveBan(b), errors.New("queue full"))
+	}
 }
 
-func dumpMedia(ms chan *media) {
-	wrapTransaction(db, func(tx *sql.Tx) {
-		for len(ms) != 0 {
-			if _, e := dbInsertMedia(tx, <-ms); e != nil {
-				log.Println(e)
-			}
-		}
-	})
+func queueThreadState(s threadState) {
+	select {
+	case persistThreadState <- s:
+	default:
+		writeDeadLetter("thread_state", s, errors.New("queue full"))
+	}
 }
 
-func wrapTransaction(db *sql.DB, f func(*sql.Tx)) {
-	tx, e := db.Begin()
-	if e != nil {
-		log.Println(e)
+func queuePostState(s postState) {
+	select {
+	case persistPostState <- s:
+	default:
+		writeDeadLetter("post_state", s, errors.New("queue full"))
 	}
+}
 
-	f(tx)
+func queueReport(r reportEntry) {
+	select {
+	case persistReport <- r:
+	default:
+		writeDeadLetter("report", newArchiveReport(r), errors.New("queue full"))
+	}
+}
 
-	if e := tx.Commit(); e != nil {
-		log.Println(e)
+func showDumpStats(w http.ResponseWriter, r *http.Request) {
+	if getStaffRole(r).Title == "" {
+		msg(w, 404, "404")
+		return
 	}
+
+	type queueStats struct {
+		Depth    int `json:"depth"`
+		Capacity int `json:"capacity"`
+	}
+
+	stats := struct {
+		Queues       map[string]queueStats `json:"queues"`
+		Retries      int64                 `json:"retries"`
+		Failures     int64                 `json:"failures"`
+		DeadLettered int64                 `json:"dead_lettered"`
+		Rejected     int64                 `json:"rejected"`
+	}{
+		Queues: map[string]queueStats{
+			"threads":       {len(persistThread), cap(persistThread)},
+			"posts":         {len(persistPost), cap(persistPost)},
+			"media":         {len(persistMedia), cap(persistMedia)},
+			"bans":          {len(persistBan), cap(persistBan)},
+			"thread_states": {len(persistThreadState), cap(persistThreadState)},
+			"post_states":   {len(persistPostState), cap(persistPostState)},
+			"reports":       {len(persistReport), cap(persistReport)},
+		},
+		Retries:      atomic.LoadInt64(&dumpStats.Retries),
+		Failures:     atomic.LoadInt64(&dumpStats.Failures),
+		DeadLettered: atomic.LoadInt64(&dumpStats.DeadLettered),
+		Rejected:     atomic.LoadInt64(&dumpStats.Rejected),
+	}
+
+	writeJSON(w, marshalAPI(stats))
 }
 
 func (h *hive) recoverFromDatabase() {
 	log.Println("Recovering from database...")
+	h.recoverTagRules()
 	h.recoverThreads()
 	h.recoverPosts()
+	h.recoverReports()
+	h.recoverAppeals()
 }
 
 func (h *hive) recoverThreads() {
-	query := "SELECT id, random_mark, updated, tags, " +
-		"sticky_tags, locked, hidden FROM threads;"
+	e := store.ReadThreads(h.newThread, func(t *thread) {
+		h.Threads[t.Id] = t
+		h.attachTags(t)
+	})
 
-	rows, e := db.Query(query)
 	if e != nil {
 		log.Panic(e)
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		t := h.newThread()
-		var updated int64
-		var tid, tags, stickyTags string
-		e := rows.Scan(&tid, &t.RandomMark, &updated,
-			&tags, &stickyTags, &t.Locked, &t.Hidden)
-
-		if e != nil {
-			log.Panic(e)
-		}
-
-		t.Id = threadId(tid)
-		t.Updated = time.Unix(updated, 0)
-		t.Tags = strings.Fields(tags)
-		t.StickyTags = strings.Fields(stickyTags)
-		h.Threads[t.Id] = t
-		h.attachTags(t)
-	}
 
 	for _, t := range h.Threads {
 		t.recoverThreadStickiness()
@@ -249,32 +330,14 @@ func (t *thread) recoverThreadStickiness() {
 			}
 		}
 	})
-	dbUpdateTags(t)
-}
 
-func (h *hive) recoverPosts() {
-	query := "SELECT comment, user_addr, media, media_name, global_id, " +
-		"local_id, reply_to, time, parent_thread, hidden, authority FROM posts;"
-
-	rows, e := db.Query(query)
-	if e != nil {
+	if e := store.UpdateThreadTags(t); e != nil {
 		log.Panic(e)
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		p := &post{}
-		var tid string
-		var imgHash *string
-		var postTime *uint64
-		e := rows.Scan(&p.Comment, &p.UserAddr, &imgHash, &p.MediaName,
-			&p.GlobalId, &p.LocalId, &p.ReplyTo, &postTime,
-			&tid, &p.Hidden, &p.RoleName)
-
-		if e != nil {
-			log.Panic(e)
-		}
+}
 
+func (h *hive) recoverPosts() {
+	e := store.ReadPosts(func(p *post, imgHash *string) {
 		var ok bool
 		if imgHash != nil {
 			if p.Media, ok = mediaStore.byHash[*imgHash]; !ok {
@@ -290,9 +353,11 @@ func (h *hive) recoverPosts() {
 		p.Recovered = true
 		p.Bytes = []byte{}
 		p.Replies = []postRef{}
-		p.ParentThread = threadId(tid)
-		p.Time = time.Unix(int64(*postTime), 0)
 		h.AddPost(p)
+	})
+
+	if e != nil {
+		log.Panic(e)
 	}
 
 	for _, t := range h.Threads {
@@ -300,9 +365,45 @@ func (h *hive) recoverPosts() {
 	}
 }
 
+// Refill the report queues and each post's report history.
+func (h *hive) recoverReports() {
+	queues := h.reportQueues()
+	e := store.ReadReports(func(r reportEntry) {
+		t, ok := h.Threads[r.Thread]
+		if !ok {
+			return
+		}
+
+		p, ok := t.PostById[r.Lid]
+		q, qok := queues[r.Queue]
+		if !ok || !qok {
+			log.Printf("Dropping report on %s/%d: post or queue not found",
+				string(r.Thread), r.Lid)
+			return
+		}
+
+		p.ReportedBy[r.SubmitterAddr] = true
+		q.AddPostToReportQueue(p)
+		p.ReportHistory[q.Id] = append(p.ReportHistory[q.Id], r.report)
+	})
+
+	if e != nil {
+		log.Panic(e)
+	}
+}
+
+// Appeal queue posts are not dumped, so requeue appeals still awaiting a
+// decision.
+func (h *hive) recoverAppeals() {
+	for _, ban := range siteUsers.PendingAppeals() {
+		h.QueueAppeal(ban)
+	}
+}
+
 func initDbLoop() {
 	if settings.Database.PostQueueSize < 1 ||
-		settings.Database.ThreadQueueSize < 1 {
+		settings.Database.ThreadQueueSize < 1 ||
+		settings.Database.StateQueueSize < 1 {
 		log.Fatal("Database queue sizes must be greater than zero")
 	}
 
@@ -310,15 +411,31 @@ func initDbLoop() {
 	persistThread = make(chan *thread, settings.Database.ThreadQueueSize)
 	persistMedia = make(chan *media, settings.Database.MediaQueueSize)
 	persistBan = make(chan *userBan, settings.Database.BanQueueSize)
+	persistPostState = make(chan postState, settings.Database.StateQueueSize)
+	persistThreadState = make(chan threadState,
+		settings.Database.StateQueueSize)
+	persistReport = make(chan reportEntry, settings.Database.StateQueueSize)
 	dumpTicker := time.NewTicker(settings.Database.DumpInterval.Duration)
 
 	go func() {
 		for {
 			<-dumpTicker.C
-			dumpThreads(persistThread)
-			dumpMedia(persistMedia)
-			dumpPosts(persistPost)
-			dumpBans(persistBan)
+			dumpAll()
 		}
 	}()
 }
+
+// Flush all persistence queues to the database. Serialized so that on-demand
+// flushes don't overlap with the dump loop.
+func dumpAll() {
+	dumpMtx.Lock()
+	defer dumpMtx.Unlock()
+
+	dumpThreads(persistThread)
+	dumpMedia(persistMedia)
+	dumpPosts(persistPost)
+	dumpBans(persistBan)
+	dumpThreadStates(persistThreadState)
+	dumpPostStates(persistPostState)
+	dumpReports(persistReport)
+}
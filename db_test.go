@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPersistBatch(t *testing.T) {
+	failure := errors.New("database is locked")
+	rowFailure := &batchError{map[int]error{1: errors.New("constraint")}}
+
+	cases := []struct {
+		name    string
+		retries int
+		results []error // Returned by successive writes; nil after these.
+		writes  int
+		dead    []string // Records sent to the dead-letter file.
+	}{
+		{"success", 3, nil, 1, nil},
+		{"retried", 3, []error{failure, failure}, 3, nil},
+		{"exhausted", 2, []error{failure, failure, failure}, 3,
+			[]string{"a", "b", "c"}},
+		{"no retries", 0, []error{failure}, 1, []string{"a", "b", "c"}},
+		{"failed row", 3, []error{rowFailure}, 1, []string{"b"}},
+	}
+
+	for _, c := range cases {
+		settings = &tolxankaConfigToml{}
+		settings.Database.DumpRetries = c.retries
+		settings.Database.RetryBackoff.Duration = time.Millisecond
+		settings.Database.DeadLetterFile = filepath.Join(t.TempDir(),
+			"deadletter.jsonl")
+
+		records := []string{"a", "b", "c"}
+		writes := 0
+		persistBatch("test", len(records),
+			func() error {
+				writes++
+				if writes <= len(c.results) {
+					return c.results[writes-1]
+				}
+				return nil
+			},
+			func(i int) interface{} { return records[i] })
+
+		if writes != c.writes {
+			t.Errorf("%s: %d writes, want %d", c.name, writes, c.writes)
+		}
+
+		dead := readDeadLetters(t, settings.Database.DeadLetterFile)
+		if !reflect.DeepEqual(dead, c.dead) {
+			t.Errorf("%s: dead-lettered %v, want %v", c.name, dead, c.dead)
+		}
+	}
+}
+
+func TestPersistBatchEmpty(t *testing.T) {
+	persistBatch("test", 0,
+		func() error {
+			t.Error("empty batch was written")
+			return nil
+		},
+		func(i int) interface{} { return nil })
+}
+
+// Records of kind "test" in a dead-letter file, or nil if there is none.
+func readDeadLetters(t *testing.T, path string) []string {
+	f, e := os.Open(path)
+	if os.IsNotExist(e) {
+		return nil
+	} else if e != nil {
+		t.Fatal(e)
+	}
+	defer f.Close()
+
+	var out []string
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		var dl struct {
+			Kind   string
+			Error  string
+			Record string
+		}
+		if e := json.Unmarshal(lines.Bytes(), &dl); e != nil {
+			t.Fatal(e)
+		}
+		if dl.Kind != "test" || dl.Error == "" {
+			t.Errorf("unexpected dead letter %s", lines.Text())
+		}
+		out = append(out, dl.Record)
+	}
+	return out
+}
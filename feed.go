@@ -0,0 +1,198 @@
+//
+// feed.go
+//
+// Atom feeds for tag queries and individual threads. Query feeds go through
+// showTagQuery like any other view, so they are subject to the same NSFW
+// and restricted tag rules as the catalog.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const feedPrefix = "/feed/"
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func newAtomFeed(title, base, path string, updated time.Time) *atomFeed {
+	return &atomFeed{
+		Title:   title,
+		Id:      base + path,
+		Updated: atomTime(updated),
+		Link: []atomLink{
+			{Href: base + path, Rel: "self"},
+		},
+		Author:  atomAuthor{settings.General.SiteName},
+		Entries: []atomEntry{},
+	}
+}
+
+func writeAtom(w http.ResponseWriter, feed *atomFeed) {
+	w.Header().Set("Content-Type", "application/atom+xml; charset=UTF-8")
+	w.Write([]byte(xml.Header))
+
+	if e := xml.NewEncoder(w).Encode(feed); e != nil {
+		log.Println(e)
+	}
+}
+
+// Title an entry after the start of its comment.
+func entryTitle(p *post, fallback string) string {
+	if p.Comment == "" {
+		return fallback
+	}
+	return truncate(100, strings.SplitN(p.Comment, "\n", 2)[0])
+}
+
+// Write feed of query result threads, most recently updated first.
+func (h *hive) writeQueryFeed(normal, sticky []*thread, search parsedQuery) {
+	threads := append(threadsByUpdate{}, normal...)
+	for _, t := range sticky {
+		if !t.Hidden || search.Admin {
+			threads = append(threads, t)
+		}
+	}
+	sort.Sort(threads)
+
+	var updated time.Time
+	if len(threads) > 0 {
+		updated = threads[0].Updated
+	}
+
+	title := settings.General.SiteName + " - " +
+		strings.Join(sanitizeLabels(strings.Fields(search.QueryString)), " ")
+	feed := newAtomFeed(title, search.BaseURL,
+		feedPrefix+"cat/"+uriEncode(search.QueryString), updated)
+
+	for _, t := range threads {
+		op := t.Posts[0]
+		link := fmt.Sprintf("%s/t/%s", search.BaseURL, t.Id)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   entryTitle(op, "Thread "+string(t.Id)),
+			Id:      fmt.Sprintf("%s?mark=%d", link, t.RandomMark),
+			Updated: atomTime(t.Updated),
+			Link:    atomLink{Href: link},
+			Content: atomContent{"html", string(op.EscapedComment)},
+		})
+	}
+
+	writeAtom(search.WriteOut, feed)
+}
+
+// /feed/cat/<query>
+func showQueryFeed(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimPrefix(r.URL.Path, feedPrefix+"cat/")
+	if query == "" {
+		msg(w, 404, "404")
+		return
+	}
+
+	showTagQuery(0, query, "atom")(w, r)
+}
+
+// /feed/t/<thread id>
+func showThreadFeed(w http.ResponseWriter, r *http.Request) {
+	tid := threadId(strings.TrimPrefix(r.URL.Path, feedPrefix+"t/"))
+	role := getStaffRole(r)
+	base := "http://" + r.Host
+
+	nsfw, e := r.Cookie("show_nsfw")
+	showNsfw := e == nil && nsfw.Value == "true"
+
+	var feed *atomFeed
+	hiveReq(func(h *hive) {
+		t, ok := h.Threads[tid]
+		if !ok || (t.Hidden && !role.SeeHiddenThreads) ||
+			(t.Nsfw && !showNsfw) {
+			return
+		}
+
+		for _, labels := range [][]string{t.Tags, t.StickyTags} {
+			for _, label := range labels {
+				if !validTag(label) && !role.ViewRestrictedTags {
+					return
+				}
+			}
+		}
+
+		op := t.Posts[0]
+		title := settings.General.SiteName + " - " +
+			entryTitle(op, "Thread "+string(t.Id))
+		feed = newAtomFeed(title, base, feedPrefix+"t/"+string(t.Id),
+			t.Updated)
+
+		for i := len(t.Posts) - 1; i >= 0; i-- {
+			p := t.Posts[i]
+			if p.Hidden {
+				continue
+			}
+
+			link := fmt.Sprintf("%s/t/%s#%d", base, t.Id, p.LocalId)
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title: entryTitle(p, fmt.Sprintf("Post %d", p.LocalId)),
+				Id: fmt.Sprintf("%s/t/%s?mark=%d#%d",
+					base, t.Id, t.RandomMark, p.LocalId),
+				Updated: atomTime(p.Time),
+				Link:    atomLink{Href: link},
+				Content: atomContent{"html", string(p.EscapedComment)},
+			})
+		}
+	})
+
+	if feed == nil {
+		msg(w, 404, "404")
+		return
+	}
+
+	writeAtom(w, feed)
+}
+
+// sort interface implementation for threads, most recently updated first.
+type threadsByUpdate []*thread
+
+func (ts threadsByUpdate) Len() int      { return len(ts) }
+func (ts threadsByUpdate) Swap(i, j int) { ts[i], ts[j] = ts[j], ts[i] }
+func (ts threadsByUpdate) Less(i, j int) bool {
+	return ts[i].Updated.After(ts[j].Updated)
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"html/template"
 	"log"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,7 +22,11 @@ type hive struct {
 	AggregateQueue    *thread
 	IllegalQueue      *thread
 	RuleQueue         *thread
+	AppealQueue       *thread
+	MediaQueue        *thread
 	tags              tagMap
+	comments          commentIndex
+	rules             tagRules
 	escaper           func(string) string
 	ThreadFields      []fieldNames
 	ThreadForm        template.HTML
@@ -28,10 +35,12 @@ type hive struct {
 
 func newHive() *hive {
 	h := &hive{
-		Threads: map[threadId]*thread{},
-		Posts:   map[postGid]*post{},
-		escaper: genMarkup(),
-		tags:    map[string]*tag{},
+		Threads:  map[threadId]*thread{},
+		Posts:    map[postGid]*post{},
+		escaper:  genMarkup(),
+		tags:     map[string]*tag{},
+		comments: commentIndex{},
+		rules:    newTagRules(),
 	}
 	h.UpdateThreadForm()
 	h.createReportQueues()
@@ -69,6 +78,36 @@ func (h *hive) createReportQueues() {
 	h.AggregateQueue = createQueue("Aggregate report queue")
 	h.IllegalQueue = createQueue("Illegal content report queue")
 	h.RuleQueue = createQueue("General rule violation content report queue")
+	h.AppealQueue = createQueue("Ban appeal queue")
+	h.MediaQueue = createQueue("Similar media review queue")
+}
+
+// Post a ban appeal into the appeal queue for staff review. The appeal is
+// shown to staff as written, so it skips the limits and filters on posts.
+func (h *hive) QueueAppeal(ban *userBan) {
+	p := &post{
+		Comment: fmt.Sprintf("Appeal against ban for %s (%s - %s):\n%s",
+			ban.Reason.Description,
+			ban.Start.Format(settings.General.PostTimeFormat),
+			ban.End.Format(settings.General.PostTimeFormat),
+			ban.Appeal.Text),
+		UserAddr:     ban.Addr,
+		ParentThread: h.AppealQueue.Id,
+		NoDump:       true,
+	}
+
+	h.addInternalPost(h.AppealQueue, p)
+	ban.Appeal.Post = p.GlobalId
+}
+
+// Add a post made by the board itself to an internal thread. It isn't
+// checked, persisted or indexed for comment search like users' posts.
+func (h *hive) addInternalPost(t *thread, p *post) {
+	h.PostCount++
+	p.GlobalId = postGid(h.PostCount)
+	p.EscapedComment = template.HTML(h.escaper(p.Comment))
+	t.AddPost(p)
+	h.Posts[p.GlobalId] = p
 }
 
 func constrainPost(t *thread, p *post) error {
@@ -98,6 +137,11 @@ func (h *hive) AddPost(p *post) (postRef, error) {
 	var t *thread
 	var e error
 
+	if !p.Recovered && !p.NoDump && !persistRoom(p.OP) {
+		atomic.AddInt64(&dumpStats.Rejected, 1)
+		return postRef{}, errors.New("database_busy")
+	}
+
 	if p.OP {
 		t, e = h.newThreadFromPost(p)
 		if e != nil {
@@ -124,18 +168,27 @@ func (h *hive) AddPost(p *post) (postRef, error) {
 	p.EscapedImageName = template.HTML(h.escaper(p.MediaName))
 	t.AddPost(p)
 
+	// Internal threads such as the report queues stay out of comment search.
+	if !t.NoDump {
+		h.comments.Add(p)
+	}
+
 	if !p.Recovered && !p.NoDump {
 		persistPost <- p
 	}
 
-	for _, label := range t.Tags {
-		tag, ok := h.tags[label]
-		if ok {
-			tag.Bump(t)
+	if t.BumpedBy(p) {
+		t.Bumped = p.Time
+		for _, label := range t.Tags {
+			tag, ok := h.tags[label]
+			if ok {
+				tag.Bump(t)
+			}
 		}
 	}
 
-	if !p.Recovered && t.Count.Posts >= settings.Limit.PostsPerThread {
+	// Internal threads such as the report queues have no reply limit.
+	if !p.Recovered && !t.NoDump && t.Count.Posts >= settings.Limit.PostsPerThread {
 		lockPost := &post{
 			Comment: "Reply limit reached. Thread locked.",
 			Role:    settings.Roles["Bot"],
@@ -160,10 +213,10 @@ func (h *hive) ReportPost(gid postGid, reason, ip string) error {
 	}
 	p.ReportedBy[ip] = true
 
-	queues := []*thread{h.AggregateQueue}
+	queues := []string{"aggregate"}
 	switch reason {
 	case "rule_violation":
-		queues = append(queues, h.RuleQueue)
+		queues = append(queues, "rule")
 	case "illegal":
 		timesReported := len(p.ReportHistory[h.IllegalQueue.Id]) + 1
 		log.Printf("times reported: %v", timesReported)
@@ -174,28 +227,74 @@ func (h *hive) ReportPost(gid postGid, reason, ip string) error {
 			h.HidePost(p)
 		}
 
-		queues = append(queues, h.IllegalQueue)
+		queues = append(queues, "illegal")
 	}
 
 	userReport := report{ip, time.Now()}
-	for _, q := range queues {
+	reportQueues := h.reportQueues()
+	for _, name := range queues {
+		q := reportQueues[name]
 		q.AddPostToReportQueue(p)
 		p.ReportHistory[q.Id] = append(p.ReportHistory[q.Id], userReport)
+
+		if !p.NoDump {
+			queueReport(reportEntry{p.ParentThread, p.LocalId, name,
+				userReport})
+		}
 	}
 
 	return nil
 }
 
+// Report queues by the name they are stored under in the database.
+func (h *hive) reportQueues() map[string]*thread {
+	return map[string]*thread{
+		"aggregate": h.AggregateQueue,
+		"illegal":   h.IllegalQueue,
+		"rule":      h.RuleQueue,
+		"media":     h.MediaQueue,
+	}
+}
+
+// Queue a post whose media resembles blocked media for staff review.
+func (h *hive) QueueMediaReview(p *post) {
+	q := h.MediaQueue
+	review := report{"", time.Now()}
+	q.AddPostToReportQueue(p)
+	p.ReportHistory[q.Id] = append(p.ReportHistory[q.Id], review)
+
+	if !p.NoDump {
+		queueReport(reportEntry{p.ParentThread, p.LocalId, "media", review})
+	}
+}
+
 func (h *hive) TagQuery(search parsedQuery) {
+	search.Expr = renameTags(search.Expr, h.rules.Canonical)
+	for _, names := range [][]string{search.Filter, search.Merge, search.Exclude} {
+		for i, name := range names {
+			names[i] = h.rules.Canonical(name)
+		}
+	}
+
 	page := search.Page
 	normal, n := h.tags.Query(
 		page*settings.Catalog.ThreadsPerPage,
 		(page+1)*settings.Catalog.ThreadsPerPage,
-		search)
+		search, h.comments.Threads(search.Comment))
 
 	sticky := []*thread{}
 	if page == 0 {
-		sticky = h.tags.GetStickyThreads(append(search.Merge, search.Filter...))
+		sticky = h.tags.GetStickyThreads(positiveTags(search.Expr))
+	}
+
+	switch search.View {
+	case "json":
+		writeJSON(search.WriteOut, marshalAPI(
+			newAPIQuery(normal, sticky, n, search)))
+		return
+	case "atom":
+		h.writeQueryFeed(normal, sticky, search)
+		return
 	}
 
 	h.assembleResultsPage(normal, sticky, n, page, search)
@@ -231,7 +330,7 @@ func (h *hive) buildNewThread(tags []string) (*thread, error) {
 	}
 
 	t := h.newThread()
-	t.Tags = append(tags, "!!_all")
+	t.Tags = append(h.rules.Expand(tags), "!!_all")
 	h.Threads[t.Id] = t
 	h.attachTags(t)
 	h.pruneThreads()
@@ -252,7 +351,7 @@ func (h *hive) newThread() *thread {
 		HanGen:      hanGenerator(),
 		HanMap:      map[string]han{},
 		UserIds:     map[uint64]bool{},
-		Listeners:   []wsRegistration{},
+		Listeners:   []*wsRegistration{},
 	}
 }
 
@@ -271,15 +370,21 @@ func (h *hive) attachTags(t *thread) {
 			t.Nsfw = true
 		}
 
-		subject, ok := h.tags[name]
-		if !ok {
-			subject = newTag(name)
-			h.tags[name] = subject
-		}
-		subject.AddThread(t)
+		h.tagNamed(name).AddThread(t)
 	}
 
 	h.tags.genAutocompleteXml()
+	tagDirectory.SetStale()
+}
+
+// Get a tag by name, creating it if it doesn't exist yet.
+func (h *hive) tagNamed(name string) *tag {
+	subject, ok := h.tags[name]
+	if !ok {
+		subject = newTag(name)
+		h.tags[name] = subject
+	}
+	return subject
 }
 
 func cleanUserTags(p *post) ([]string, error) {
@@ -308,13 +413,15 @@ func cleanUserTags(p *post) ([]string, error) {
 	return out, nil
 }
 
-func (h *hive) AddThreadListener(reg wsRegistration) {
+func (h *hive) AddThreadListener(reg *wsRegistration) {
 	t, ok := h.Threads[reg.Thread]
 	if !ok {
+		reg.Close()
 		return
 	}
 
-	h.Threads[reg.Thread].Listeners = append(t.Listeners, reg)
+	t.pruneListeners()
+	t.Listeners = append(t.Listeners, reg)
 }
 
 func lockThread(tid threadId, val bool) {
@@ -327,11 +434,15 @@ func lockThread(tid threadId, val bool) {
 		t.Locked = val
 		t.UpdateThreadSummary()
 		pageCache.SetStale(string(tid), t.Hidden)
+		t.broadcast(threadLockedEvent(t))
+		t.persistState()
 	})
+}
 
-	cmd := ("UPDATE threads SET locked = ?1 WHERE id = ?2;")
-	if _, e := db.Exec(cmd, val, string(tid)); e != nil {
-		log.Panic(e)
+// Queue the thread's current moderation state to be written to the database.
+func (t *thread) persistState() {
+	if !t.NoDump {
+		queueThreadState(threadState{t.Id, t.Locked, t.Hidden})
 	}
 }
 
@@ -367,8 +478,14 @@ func (h *hive) StickyThread(tid threadId, stickyTags []string) {
 			}
 		}
 	}
+	tagDirectory.SetStale()
+
+	if e := store.UpdateThreadTags(t); e != nil {
+		log.Panic(e)
+	}
 
-	dbUpdateTags(t)
+	pageCache.SetStale(string(t.Id), t.Hidden)
+	t.broadcast(threadStickiedEvent(t))
 }
 
 func (t *thread) setSticky(name string) {
@@ -389,20 +506,6 @@ func (t *thread) setUnsticky(name string) {
 	}
 }
 
-func dbUpdateTags(t *thread) {
-	tags := strings.Join(t.Tags, " ")
-	tagsCmd := ("UPDATE threads SET tags = ?1 WHERE id = ?2;")
-	if _, e := db.Exec(tagsCmd, tags, string(t.Id)); e != nil {
-		log.Panic(e)
-	}
-
-	sticky := strings.Join(t.StickyTags, " ")
-	stickyCmd := ("UPDATE threads SET sticky_tags = ?1 WHERE id = ?2;")
-	if _, e := db.Exec(stickyCmd, sticky, string(t.Id)); e != nil {
-		log.Panic(e)
-	}
-}
-
 // create copy of posts in received pointers, set copies' showaddr to true,
 // then run template.
 func (h *hive) ModPosts(posts []*post) []byte {
@@ -432,6 +535,10 @@ func (h *hive) HidePost(p *post) {
 	affectedThreads := map[threadId]*thread{}
 	p.Hidden = true
 
+	if !p.NoDump {
+		queuePostState(postState{p.ParentThread, p.LocalId, true})
+	}
+
 	if t, ok := h.Threads[p.ParentThread]; ok {
 		affectedThreads[p.ParentThread] = t
 	}
@@ -445,6 +552,35 @@ func (h *hive) HidePost(p *post) {
 	for _, t := range affectedThreads {
 		pageCache.SetStale(string(t.Id), t.Hidden)
 	}
+
+	if t, ok := h.Threads[p.ParentThread]; ok {
+		t.broadcast(postHiddenEvent(p))
+	}
+}
+
+// Hide a reply at the request of its poster, provided the deletion window
+// hasn't passed.
+func (h *hive) DeleteOwnPost(gid postGid, secret string) (threadId, error) {
+	p := h.GetPost(gid)
+	if p == nil || p.Hidden {
+		return "", errors.New("post_not_exist")
+	}
+
+	if p.DeleteSecret == "" ||
+		subtle.ConstantTimeCompare([]byte(p.DeleteSecret), []byte(secret)) != 1 {
+		return "", errors.New("not_post_owner")
+	}
+
+	if p.OP {
+		return "", errors.New("op_not_deletable")
+	}
+
+	if time.Since(p.Time) > settings.Limit.DeleteWindow.Duration {
+		return "", errors.New("delete_window_passed")
+	}
+
+	h.HidePost(p)
+	return p.ParentThread, nil
 }
 
 // Remove thread from threadLists in each tag, then from the hive itself,
@@ -468,12 +604,17 @@ func (h *hive) DeleteThread(tid threadId) {
 		}
 	}
 
+	for _, p := range t.Posts {
+		h.comments.Remove(p)
+	}
+	tagDirectory.SetStale()
+
 	log.Println("Deleting thread " + string(tid))
+	t.closeListeners(threadDeletedEvent(t))
 	delete(h.Threads, tid)
 	pageCache.Purge(string(tid))
 
-	cmd := ("DELETE FROM threads WHERE id = ?1;")
-	if _, e := db.Exec(cmd, string(tid)); e != nil {
+	if e := store.DeleteThread(tid); e != nil {
 		log.Panic(e)
 	}
 }
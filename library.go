@@ -2,33 +2,39 @@ package main
 
 import (
 	"bytes"
-	"container/list"
 	"crypto/md5"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/nfnt/resize"
+	"hash/crc32"
 	"image"
+	"image/color"
 	_ "image/gif"
 	"image/jpeg"
-	_ "image/png"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/bits"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type media struct {
-	Hash       string
-	Full       []byte // full image
-	Thumb      []byte // resized thumbnail
-	MediaType  string
-	InfoString string
-	Size       int
-	InMemory   bool
-	Blocked    *banReason
+	Hash        string // MD5, naming the media everywhere
+	SHA256      string // for matching against external hash lists
+	PHash       string // perceptual hash of images and video keyframes
+	Thumb       []byte // resized thumbnail
+	MediaType   string
+	ContentType string // MIME type of the upload, from AcceptedFileFormats
+	InfoString  string
+	Size        int
+	Blocked     *banReason
 
 	// References to this image by active threads. These are stored
 	// in this structure with the images but they're managed by the
@@ -56,50 +62,153 @@ func sizeString(size int) string {
 	return sizeString
 }
 
-func (i *media) writeToDisk() {
-	if len(i.Full) == 0 {
-		log.Println("full media not in media struct, not writing to disk")
-		return
+func (i *media) FileName() string {
+	baseName := i.Hash
+	return filepath.Join(settings.Media.Path, baseName)
+}
+
+// Media by hash. Thumbnails are kept in memory; full files are served from
+// disk.
+type library struct {
+	byHash map[string]*media
+
+	mtx sync.RWMutex
+}
+
+// Add an upload to the library. The content is streamed to a temporary file
+// and hashed before anything else, so a repeat upload gets the media already
+// stored, blocked or not, and only new content is processed and persisted.
+// With SimilarAction = "reject", media resembling blocked media comes back
+// blocked, whether it is new or was stored before the block.
+func (lib *library) dispatch(r io.Reader, format string) (*media, error) {
+	var process func(i *media) error
+	switch {
+	case inList(settings.Image.AcceptedFileFormats, format):
+		process = processImage
+	case inList(settings.Video.AcceptedFileFormats, format):
+		process = processVideo
+	case inList(settings.Audio.AcceptedFileFormats, format):
+		process = processAudio
+	default:
+		return nil, errors.New("invalid format")
 	}
 
-	imgFile, e := os.Create(i.FileName())
+	i, tmpName, e := spoolUpload(r)
 	if e != nil {
-		log.Println("Failed creating media file: " + e.Error())
-		return
+		return nil, e
+	}
+	defer os.Remove(tmpName)
+	i.ContentType = format
+
+	if old := lib.Lookup(i.Hash); old != nil {
+		if reason := lib.similarRejection(old); reason != nil {
+			return &media{Hash: old.Hash, Blocked: reason}, nil
+		}
+		return old, nil
+	}
+
+	// Files are named by hash, so one already in place has the same content.
+	if e := os.Rename(tmpName, i.FileName()); e != nil {
+		return nil, e
+	}
+
+	if e := process(i); e != nil {
+		lib.discard(i)
+		return nil, e
+	}
+
+	if reason := lib.similarRejection(i); reason != nil {
+		lib.discard(i)
+		i.Blocked = reason
+		return i, nil
 	}
 
-	_, e = imgFile.Write(i.Full)
+	stored := lib.DirectInsert(i)
+
+	// A concurrent upload of the same content may have been stored first.
+	if stored == i {
+		persistMedia <- i
+	}
+	return stored, nil
+}
+
+// Copy an upload into a temporary file in the media directory, hashing it
+// on the way.
+func spoolUpload(r io.Reader) (*media, string, error) {
+	f, e := ioutil.TempFile(settings.Media.Path, "upload-")
 	if e != nil {
-		log.Println("Failed writing media file: " + e.Error())
-		return
+		return nil, "", e
+	}
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	size, e := io.Copy(io.MultiWriter(f, md5Hash, sha256Hash), r)
+	if ce := f.Close(); e == nil {
+		e = ce
 	}
 
-	imgFile.Close()
+	if e != nil {
+		os.Remove(f.Name())
+		return nil, "", e
+	}
+
+	i := &media{
+		Hash:   fmt.Sprintf("%x", md5Hash.Sum(nil)),
+		SHA256: fmt.Sprintf("%x", sha256Hash.Sum(nil)),
+		Size:   int(size),
+	}
+	return i, f.Name(), nil
 }
 
-func (i *media) FileName() string {
-	baseName := i.Hash
-	return filepath.Join(settings.Media.Path, baseName)
+func (lib *library) Lookup(hash string) *media {
+	lib.mtx.RLock()
+	defer lib.mtx.RUnlock()
+	return lib.byHash[hash]
 }
 
-type library struct {
-	byHash      map[string]*media
-	CachedMedia *list.List
-	CacheSize   int
+// Remove the file of media which won't be stored, unless the same content
+// has been stored meanwhile.
+func (lib *library) discard(i *media) {
+	if lib.Lookup(i.Hash) == nil {
+		os.Remove(i.FileName())
+	}
+}
 
-	mtx sync.RWMutex
+// Find blocked media within the configured perceptual hash distance of i.
+func (lib *library) SimilarBlocked(i *media) *media {
+	if i.Blocked != nil || i.PHash == "" || settings.Media.SimilarDistance < 0 {
+		return nil
+	}
+
+	lib.mtx.RLock()
+	defer lib.mtx.RUnlock()
+
+	for _, blocked := range lib.byHash {
+		if blocked.Blocked == nil || blocked.PHash == "" {
+			continue
+		}
+
+		d, ok := hashDistance(i.PHash, blocked.PHash)
+		if ok && d <= settings.Media.SimilarDistance {
+			return blocked
+		}
+	}
+	return nil
 }
 
-func (lib *library) dispatch(media io.ReadSeeker, format string) (*media, error) {
-	switch {
-	case inList(settings.Image.AcceptedFileFormats, format):
-		return lib.InsertImage(media)
-	case inList(settings.Video.AcceptedFileFormats, format):
-		return lib.InsertVideo(media)
-	case inList(settings.Audio.AcceptedFileFormats, format):
-		return lib.InsertAudio(media)
+// The ban reason under which i is rejected for resembling blocked media, or
+// nil when it isn't similar or similar media only goes to review.
+func (lib *library) similarRejection(i *media) *banReason {
+	if settings.Media.SimilarAction == "review" {
+		return nil
+	}
+
+	match := lib.SimilarBlocked(i)
+	if match == nil {
+		return nil
 	}
-	return nil, errors.New("invalid format")
+
+	log.Printf("media %s resembles blocked media %s", i.Hash, match.Hash)
+	return match.Blocked
 }
 
 func inList(list []string, s string) bool {
@@ -111,48 +220,40 @@ func inList(list []string, s string) bool {
 	return false
 }
 
-// Insert image into lib. If MD5 collides with extant image, return the
-// old one. Store both the original and a thumbnail version as byte slices.
-// Also create full copy on disk.
-func (lib *library) InsertImage(img io.ReadSeeker) (*media, error) {
-	uploadedImage, e := ioutil.ReadAll(img)
+// Store a thumbnail and perceptual hash of a new image.
+func processImage(i *media) error {
+	img, e := os.Open(i.FileName())
 	if e != nil {
-		return nil, e
+		return e
 	}
+	defer img.Close()
 
-	img.Seek(0, 0)
 	c, _, e := image.DecodeConfig(img)
 	if e != nil {
 		log.Println("Image decoding error: " + e.Error())
-		return nil, e
+		return e
 	}
 
-	thumbImage, err := createThumb(img, c.Width, c.Height)
-	if err != nil {
-		log.Println("Thumbnailing error: " + err.Error())
-		return nil, err
+	img.Seek(0, 0)
+	decoded, _, e := image.Decode(img)
+	if e != nil {
+		log.Println("Image decoding error: " + e.Error())
+		return e
 	}
 
-	i := new(media)
 	i.MediaType = "image"
-	i.Full = uploadedImage
-	i.Thumb = thumbImage
-	i.Size = len(i.Full)
-	i.InfoString = imageInfo((i.Size), c.Width, c.Height)
-	i.InMemory = true
-
-	h := md5.New()
-	h.Write(uploadedImage)
-	i.Hash = fmt.Sprintf("%x", h.Sum(nil))
-	lib.DirectInsert(i)
-	persistMedia <- i
-
-	return i, nil
+	if i.Thumb, e = createThumb(decoded); e != nil {
+		log.Println("Thumbnailing error: " + e.Error())
+		return e
+	}
+	i.PHash = perceptualHash(decoded)
+	i.InfoString = imageInfo(i.Size, c.Width, c.Height)
+	return nil
 }
 
-// Directly insert an already processed *media into a library. This was
-// split off of the regular Insert function to aid reinsertion of old medias
-// from dump files.
+// Directly insert an already processed *media, whose file is in place, into
+// a library. This was split off of the regular Insert function to aid
+// reinsertion of old medias from dump files.
 func (lib *library) DirectInsert(i *media) *media {
 	lib.mtx.Lock()
 	defer lib.mtx.Unlock()
@@ -161,21 +262,12 @@ func (lib *library) DirectInsert(i *media) *media {
 		return old
 	}
 
-	if !lib.clearSpace(i.Size) {
-		log.Println("unable to clear space for media insertion.")
-		return nil
-	}
-
 	lib.InternalInsert(i)
-	i.writeToDisk()
-
 	return i
 }
 
 func (lib *library) InternalInsert(i *media) *media {
 	lib.byHash[i.Hash] = i
-	lib.CachedMedia.PushBack(i)
-	lib.CacheSize += i.Size
 	return i
 }
 
@@ -183,58 +275,24 @@ func (lib *library) Block(i *media, reason banReason) error {
 	lib.mtx.Lock()
 	defer lib.mtx.Unlock()
 
+	// The file is needed to catch copies later, so hash it while it's here.
+	if i.PHash == "" {
+		if hash, e := mediaPHash(i); e == nil && hash != "" {
+			i.PHash = hash
+			if e := store.UpdateMediaPHash(i); e != nil {
+				return e
+			}
+		}
+	}
+
 	if e := os.Remove(i.FileName()); e != nil {
 		return e
 	}
 
 	i.Thumb = []byte{}
-	i.Full = []byte{}
-	i.InMemory = false
 	i.Blocked = &reason
 
-	stmt := "INSERT INTO media (hash, ban_reason) VALUES (?1, ?2);"
-	if _, e := db.Exec(stmt); e != nil {
-		return e
-	}
-
-	return nil
-}
-
-// loop through cached media list, removing media until the specified amount
-// in memory is cleared.
-func (lib *library) clearSpace(size int) bool {
-	if settings.Media.CacheSize < size {
-		log.Println("image above max cache size")
-		return false
-	}
-
-	elem := lib.CachedMedia.Front()
-
-	for {
-		if (settings.Media.CacheSize - lib.CacheSize) > size {
-			return true
-		}
-
-		if elem == nil {
-			log.Println("elem is nil, breaking.")
-			break
-		}
-
-		i := elem.Value.(*media)
-		i.InMemory = false
-		i.Full = []byte{}
-
-		next := elem.Next()
-		lib.CachedMedia.Remove(elem)
-		lib.CacheSize -= i.Size
-		log.Printf("Removing media %s, size: %d. Cache now: %d",
-			i.Hash, i.Size, lib.CacheSize)
-
-		elem = next
-	}
-
-	log.Println("reached end of cache list, could not clear enough space.")
-	return false
+	return store.BlockMedia(i)
 }
 
 func (lib *library) IncRef(i *media) {
@@ -252,64 +310,59 @@ func (lib *library) DecRef(i *media) {
 	lib.mtx.Unlock()
 }
 
-func (lib *library) WriteMedia(
-	w http.ResponseWriter, hash string, full bool) {
-
-    var inMemory, wroteThumb, ok bool
-    var i *media
-
-    checkAndHandleThumb := func() {
-        lib.mtx.RLock()
-        defer lib.mtx.RUnlock()
-
-        i, ok = lib.byHash[hash]
-        if !ok || i.Blocked != nil {
-            return
-        }
-
-        if !full {
-            w.Write(i.Thumb)
-            wroteThumb = true
-            return
-        }
-    }
+// Serve media or its thumbnail. Content is identified by hash, which makes
+// it the ETag, and http.ServeContent handles conditional and range requests.
+// A thumbnail's ETag also carries a checksum of the thumbnail, so caches
+// pick up thumbnails rebuilt by the thumbnails command.
+// Full media is served as the type it was uploaded with; thumbnails, and
+// media stored before types were recorded, have theirs detected.
+func (lib *library) WriteMedia(w http.ResponseWriter, r *http.Request,
+	hash string, full bool) {
+
+	lib.mtx.RLock()
+	i, ok := lib.byHash[hash]
+	var thumb []byte
+	if ok && i.Blocked == nil {
+		thumb = i.Thumb
+	}
+	lib.mtx.RUnlock()
 
-    readFromDisk := func() {
-        lib.mtx.Lock()
-        defer lib.mtx.Unlock()
+	if !ok || i.Blocked != nil {
+		http.NotFound(w, r)
+		return
+	}
 
-		imgFile, e := os.Open(i.FileName())
-		if e != nil {
-			log.Println("Failed opening media file: " + e.Error())
-			return
-		}
+	if !full {
+		etag := fmt.Sprintf(`"%s-thumb-%08x"`, hash, crc32.ChecksumIEEE(thumb))
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(thumb))
+		return
+	}
 
-		i.Full = make([]byte, i.Size)
-		_, e = imgFile.Read(i.Full)
-		if e != nil {
-			log.Println("Failed reading media file: " + e.Error())
-			return
-		}
+	w.Header().Set("ETag", `"`+hash+`"`)
+	if i.ContentType != "" {
+		w.Header().Set("Content-Type", i.ContentType)
+	}
 
-		i.InMemory = true
-    }
+	f, e := os.Open(i.FileName())
+	if e != nil {
+		log.Println("Failed opening media file: " + e.Error())
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
 
-    checkAndHandleThumb()
-    if wroteThumb {
-        return
-    } else if !inMemory {
-        readFromDisk()
-    }
+	var modTime time.Time
+	if fi, e := f.Stat(); e == nil {
+		modTime = fi.ModTime()
+	}
 
-    lib.mtx.RLock()
-    defer lib.mtx.RUnlock()
-    w.Write(i.Full)
+	http.ServeContent(w, r, "", modTime, f)
 }
 
 func newLibrary() *library {
 	lib := new(library)
 	lib.byHash = map[string]*media{}
-	lib.CachedMedia = list.New()
 	lib.readFromDatabase()
 	return lib
 }
@@ -318,56 +371,264 @@ func (lib *library) readFromDatabase() {
 	lib.mtx.Lock()
 	defer lib.mtx.Unlock()
 
-	query := "SELECT hash, thumb, type, info, size, ban_reason FROM media;"
+	e := store.ReadMedia(func(i *media, reasonName string) {
+		if reasonName != "" {
+			reason, ok := settings.BanReasons[reasonName]
+			if !ok {
+				log.Panic("Media block ban reason not found: " + reasonName)
+			}
+
+			i.Blocked = &reason
+		}
+
+		lib.InternalInsert(i)
+	})
 
-	rows, e := db.Query(query)
 	if e != nil {
 		log.Panic(e)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		i := new(media)
+	lib.fillSHA256()
+	lib.fillPHash()
+}
+
+// Media stored before SHA-256 hashes were recorded gets them from its file.
+// Blocked media has no file left to hash.
+func (lib *library) fillSHA256() {
+	for _, i := range lib.byHash {
+		if i.SHA256 != "" || i.Blocked != nil {
+			continue
+		}
+
+		f, e := os.Open(i.FileName())
+		if e != nil {
+			log.Println("Failed hashing media file: " + e.Error())
+			continue
+		}
 
-		var reasonName string
-		e := rows.Scan(&i.Hash, &i.Thumb, &i.MediaType,
-			&i.InfoString, &i.Size, &reasonName)
+		h := sha256.New()
+		_, e = io.Copy(h, f)
+		f.Close()
 		if e != nil {
+			log.Println("Failed hashing media file: " + e.Error())
+			continue
+		}
+
+		i.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
+		if e := store.UpdateMediaSHA256(i); e != nil {
 			log.Panic(e)
 		}
+	}
+}
 
-		if reasonName != "" {
-			reason, ok := settings.BanReasons[reasonName]
-			if !ok {
-				log.Panic("Media block ban reason not found: " + reasonName)
-			}
+// Media stored before perceptual hashes were recorded gets them too, so
+// copies of it are caught if staff block it later.
+func (lib *library) fillPHash() {
+	for _, i := range lib.byHash {
+		if i.PHash != "" || i.Blocked != nil || i.MediaType == "audio" {
+			continue
+		}
 
-			i.Blocked = &reason
+		hash, e := mediaPHash(i)
+		if e != nil {
+			log.Printf("Failed hashing media %s: %s", i.Hash, e)
+			continue
 		}
 
-		lib.InternalInsert(i)
+		i.PHash = hash
+		if e := store.UpdateMediaPHash(i); e != nil {
+			log.Panic(e)
+		}
 	}
 }
 
-func createThumb(file io.ReadSeeker, x, y int) ([]byte, error) {
-	file.Seek(0, 0)
-	img, _, err := image.Decode(file)
-	if err != nil {
-		return []byte{}, errors.New("Could not decode image.")
+// Perceptual hash of an image's file, or of a video's keyframe thumbnail.
+// Audio has none.
+func mediaPHash(i *media) (string, error) {
+	var img image.Image
+	var e error
+
+	switch i.MediaType {
+	case "image":
+		f, e := os.Open(i.FileName())
+		if e != nil {
+			return "", e
+		}
+		defer f.Close()
+
+		img, _, e = image.Decode(f)
+		if e != nil {
+			return "", e
+		}
+	case "video":
+		img, _, e = image.Decode(bytes.NewReader(i.Thumb))
+		if e != nil {
+			return "", e
+		}
+	default:
+		return "", nil
 	}
 
-	var newHeight, newWidth uint
-	if x > y {
-		newWidth = uint(settings.Image.ThumbWidth)
-		newHeight = uint((settings.Image.ThumbWidth / x) * y)
-	} else {
-		newHeight = uint(settings.Image.ThumbHeight)
-		newWidth = uint((settings.Image.ThumbHeight / x) * y)
+	return perceptualHash(img), nil
+}
+
+// Rebuilds stored thumbnails with the current settings. The board caches
+// thumbnails in memory, so it should be stopped while this runs.
+type thumbsCommand struct{}
+
+func (c *thumbsCommand) Execute(args []string) error {
+	store = initializeDatabase()
+	defer store.Close()
+
+	ms := []*media{}
+	e := store.ReadMedia(func(i *media, reasonName string) {
+		if reasonName == "" {
+			ms = append(ms, i)
+		}
+	})
+	if e != nil {
+		return e
+	}
+
+	var failed int
+	for _, i := range ms {
+		if e := regenerateThumb(i); e != nil {
+			log.Printf("Failed thumbnailing media %s: %s", i.Hash, e)
+			failed++
+			continue
+		}
+
+		if e := store.UpdateMediaThumb(i); e != nil {
+			return e
+		}
+	}
+
+	log.Printf("Regenerated %d thumbnails, %d failed", len(ms)-failed, failed)
+	return nil
+}
+
+func regenerateThumb(i *media) error {
+	switch i.MediaType {
+	case "image":
+		f, e := os.Open(i.FileName())
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+
+		img, _, e := image.Decode(f)
+		if e != nil {
+			return e
+		}
+
+		i.Thumb, e = createThumb(img)
+		return e
+	case "video":
+		thumb, e := webmThumb(i.FileName())
+		if e != nil {
+			return e
+		}
+		i.Thumb = thumb
+	case "audio":
+		i.Thumb = audioThumbnail
 	}
+	return nil
+}
+
+// Resampling filters for thumbnails, by their name in the configuration.
+var thumbFilters = map[string]resize.InterpolationFunction{
+	"nearest":  resize.NearestNeighbor,
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"mitchell": resize.MitchellNetravali,
+	"lanczos2": resize.Lanczos2,
+	"lanczos3": resize.Lanczos3,
+}
+
+// Shrink an image to fit the configured thumbnail size. Images with any
+// transparency are thumbnailed as PNG to keep it, the rest as JPEG. An
+// animated GIF decodes to its first frame, which is what gets thumbnailed.
+func createThumb(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	width, height := thumbSize(b.Dx(), b.Dy())
+	thumb := resize.Resize(width, height, img, settings.Image.thumbFilter)
 
-	img = resize.Resize(newWidth, newHeight, img, resize.NearestNeighbor)
 	out := new(bytes.Buffer)
+	var e error
+	if hasAlpha(img) {
+		e = png.Encode(out, thumb)
+	} else {
+		e = jpeg.Encode(out, thumb, &jpeg.Options{Quality: 70})
+	}
+	return out.Bytes(), e
+}
+
+// Dimensions of an x by y image scaled down, keeping its aspect ratio, to
+// fit within ThumbWidth by ThumbHeight. Smaller images keep their size.
+func thumbSize(x, y int) (uint, uint) {
+	maxWidth, maxHeight := settings.Image.ThumbWidth, settings.Image.ThumbHeight
+	if x <= maxWidth && y <= maxHeight {
+		return uint(x), uint(y)
+	}
+
+	width, height := maxWidth, maxHeight
+	if x*maxHeight > y*maxWidth {
+		height = (y*maxWidth + x/2) / x
+	} else {
+		width = (x*maxHeight + y/2) / y
+	}
+
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return uint(width), uint(height)
+}
+
+func hasAlpha(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	return false
+}
+
+// A difference hash: the image is shrunk to 9x8 and each bit records
+// whether a pixel is brighter than its right neighbour. Resized or
+// re-encoded copies keep most bits, so similarity is the number of
+// differing bits.
+func perceptualHash(img image.Image) string {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	b := small.Bounds()
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(b.Min.X+x, b.Min.Y+y))
+			right := color.GrayModel.Convert(small.At(b.Min.X+x+1, b.Min.Y+y))
+
+			hash <<= 1
+			if left.(color.Gray).Y > right.(color.Gray).Y {
+				hash |= 1
+			}
+		}
+	}
+
+	return fmt.Sprintf("%016x", hash)
+}
+
+// Number of differing bits between two perceptual hashes.
+func hashDistance(a, b string) (int, bool) {
+	x, e := strconv.ParseUint(a, 16, 64)
+	if e != nil {
+		return 0, false
+	}
+
+	y, e := strconv.ParseUint(b, 16, 64)
+	if e != nil {
+		return 0, false
+	}
 
-	jpeg.Encode(out, img, &jpeg.Options{Quality: 70})
-	return out.Bytes(), nil
+	return bits.OnesCount64(x ^ y), true
 }
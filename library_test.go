@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+)
+
+func TestThumbSize(t *testing.T) {
+	settings = &tolxankaConfigToml{}
+
+	cases := []struct {
+		maxWidth, maxHeight int
+		x, y                int
+		width, height       uint
+	}{
+		{125, 125, 100, 50, 100, 50},
+		{125, 125, 125, 125, 125, 125},
+		{125, 125, 1000, 1000, 125, 125},
+		{125, 125, 250, 125, 125, 63},
+		{125, 125, 125, 250, 63, 125},
+		{125, 125, 300, 200, 125, 83},
+		{125, 125, 126, 10, 125, 10},
+		{125, 125, 10000, 10, 125, 1},
+		{125, 125, 10, 10000, 1, 125},
+		{200, 100, 400, 400, 100, 100},
+		{200, 100, 800, 200, 200, 50},
+		{200, 100, 150, 90, 150, 90},
+	}
+
+	for _, c := range cases {
+		settings.Image.ThumbWidth = c.maxWidth
+		settings.Image.ThumbHeight = c.maxHeight
+
+		width, height := thumbSize(c.x, c.y)
+		if width != c.width || height != c.height {
+			t.Errorf("thumbSize(%d, %d) within %dx%d = %dx%d, want %dx%d",
+				c.x, c.y, c.maxWidth, c.maxHeight, width, height,
+				c.width, c.height)
+		}
+	}
+}
+
+func TestCreateThumb(t *testing.T) {
+	settings = &tolxankaConfigToml{}
+	settings.Image.ThumbWidth = 125
+	settings.Image.ThumbHeight = 125
+	settings.Image.thumbFilter = thumbFilters["lanczos3"]
+
+	opaque := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 0xff
+	}
+
+	cases := []struct {
+		name   string
+		img    image.Image
+		format string
+	}{
+		{"opaque", opaque, "jpeg"},
+		{"gray", image.NewGray(image.Rect(0, 0, 300, 200)), "jpeg"},
+		{"transparent", image.NewRGBA(image.Rect(0, 0, 300, 200)), "png"},
+		{"paletted", image.NewPaletted(image.Rect(0, 0, 300, 200),
+			color.Palette{color.Transparent, color.Black}), "png"},
+	}
+
+	for _, c := range cases {
+		thumb, e := createThumb(c.img)
+		if e != nil {
+			t.Errorf("%s: createThumb failed: %s", c.name, e)
+			continue
+		}
+
+		conf, format, e := image.DecodeConfig(bytes.NewReader(thumb))
+		if e != nil {
+			t.Errorf("%s: thumbnail doesn't decode: %s", c.name, e)
+			continue
+		}
+
+		if format != c.format || conf.Width != 125 || conf.Height != 83 {
+			t.Errorf("%s: thumbnail is %s %dx%d, want %s 125x83", c.name,
+				format, conf.Width, conf.Height, c.format)
+		}
+	}
+}
+
+func TestHashDistance(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		distance int
+		ok       bool
+	}{
+		{"0000000000000000", "0000000000000000", 0, true},
+		{"ffffffffffffffff", "ffffffffffffffff", 0, true},
+		{"ffffffffffffffff", "0000000000000000", 64, true},
+		{"00000000000000f0", "000000000000000f", 8, true},
+		{"8000000000000000", "0000000000000001", 2, true},
+		{"f", "0000000000000001", 3, true},
+		{"", "0000000000000000", 0, false},
+		{"0000000000000000", "not a hash", 0, false},
+		{"10000000000000000", "0", 0, false},
+	}
+
+	for _, c := range cases {
+		distance, ok := hashDistance(c.a, c.b)
+		if distance != c.distance || ok != c.ok {
+			t.Errorf("hashDistance(%q, %q) = %d, %v, want %d, %v",
+				c.a, c.b, distance, ok, c.distance, c.ok)
+		}
+	}
+}
+
+// A grayscale image whose brightness at each pixel is given by f.
+func testGrayImage(width, height int, f func(x, y int) uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetGray(x, y, color.Gray{f(x, y)})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHash(t *testing.T) {
+	cases := []struct {
+		name string
+		img  image.Image
+		hash string
+	}{
+		{"flat", testGrayImage(90, 80, func(x, y int) uint8 {
+			return 128
+		}), "0000000000000000"},
+		{"darkening", testGrayImage(90, 80, func(x, y int) uint8 {
+			return uint8(255 - 2*x)
+		}), "ffffffffffffffff"},
+		{"brightening", testGrayImage(90, 80, func(x, y int) uint8 {
+			return uint8(2 * x)
+		}), "0000000000000000"},
+		{"darkening top half", testGrayImage(90, 80, func(x, y int) uint8 {
+			if y < 40 {
+				return uint8(255 - 2*x)
+			}
+			return uint8(2 * x)
+		}), "ffffffff00000000"},
+	}
+
+	for _, c := range cases {
+		if got := perceptualHash(c.img); got != c.hash {
+			t.Errorf("%s: perceptualHash = %s, want %s", c.name, got, c.hash)
+		}
+	}
+}
+
+func TestPerceptualHashCopies(t *testing.T) {
+	settings = &tolxankaConfigToml{}
+	settings.Image.ThumbWidth = 200
+	settings.Image.ThumbHeight = 200
+	settings.Image.thumbFilter = thumbFilters["bilinear"]
+
+	pattern := func(x, y int) uint8 {
+		fx, fy := float64(x), float64(y)
+		return uint8(128 + 60*math.Sin(fx/37) + 60*math.Cos(fy/23+fx/71))
+	}
+	original := testGrayImage(400, 300, pattern)
+	hash := perceptualHash(original)
+
+	// A smaller copy of the image, re-encoded as JPEG.
+	thumb, e := createThumb(original)
+	if e != nil {
+		t.Fatal(e)
+	}
+	copied, e := jpeg.Decode(bytes.NewReader(thumb))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if d, _ := hashDistance(hash, perceptualHash(copied)); d > 4 {
+		t.Errorf("resized copy is %d bits from the original, want at most 4", d)
+	}
+
+	other := testGrayImage(400, 300, func(x, y int) uint8 {
+		return pattern(y, x)
+	})
+	if d, _ := hashDistance(hash, perceptualHash(other)); d < 10 {
+		t.Errorf("different image is %d bits from the original, "+
+			"want 10 or more", d)
+	}
+
+	var buf bytes.Buffer
+	if e := png.Encode(&buf, original); e != nil {
+		t.Fatal(e)
+	}
+	decoded, e := png.Decode(&buf)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if got := perceptualHash(decoded); got != hash {
+		t.Errorf("lossless copy hashed to %s, want %s", got, hash)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/net/websocket"
-	"database/sql"
 	"github.com/gorilla/context"
 	"github.com/gorilla/sessions"
 	"github.com/jessevdk/go-flags"
@@ -23,7 +22,7 @@ const configDir = "config"
 
 var staffSessions = sessions.NewCookieStore()
 
-var db *sql.DB
+var store storage
 var mediaStore *library
 var templates *template.Template
 var text *txt.Template
@@ -31,20 +30,38 @@ var settings *tolxankaConfigToml
 var keyRing *openpgp.EntityList
 
 type Options struct {
-	Insecure bool `long:"insecure-mode" description:"Insecure Mode" optional:"yes" optional-value:"false"`
+	Insecure    bool          `long:"insecure-mode" description:"Insecure Mode" optional:"yes" optional-value:"false"`
+	MigrateOnly bool          `long:"migrate-only" description:"Upgrade the database schema and exit"`
+	Export      exportCommand `command:"export" description:"Write the board's database and media files to a tar archive"`
+	Import      importCommand `command:"import" description:"Restore an exported archive into an empty database"`
+	Thumbnails  thumbsCommand `command:"thumbnails" description:"Regenerate the thumbnail of every unblocked media file"`
 }
 
-func setConfiguration() {
+// Read configuration and command line options. Subcommands run during
+// parsing, after which there's nothing left to do.
+func setConfiguration() Options {
 	settings = readConfigToml(configDir)
 	opts := Options{}
-	flags.Parse(&opts)
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+
+	if _, e := parser.Parse(); e != nil {
+		if fe, ok := e.(*flags.Error); ok && fe.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		log.Fatal(e)
+	}
+
+	if parser.Active != nil {
+		os.Exit(0)
+	}
+
 	settings.Debug.insecureMode = opts.Insecure
+	return opts
 }
 
 // Dump hive and quit if appropriate upon receving certain signals.
-func watchSignals() chan os.Signal {
-	watcher := make(chan os.Signal)
-
+func watchSignals(watcher chan os.Signal, server *http.Server) {
 	go func() {
 		for {
 			sig := <-watcher
@@ -54,13 +71,14 @@ func watchSignals() chan os.Signal {
 			case syscall.SIGINT:
 				fallthrough
 			case syscall.SIGTERM:
+				shutdown(server)
 				os.Exit(0)
 			case syscall.SIGUSR1:
+				log.Println("Flushing database queues.")
+				dumpAll()
 			}
 		}
 	}()
-
-	return watcher
 }
 
 func installHandlers() {
@@ -75,12 +93,20 @@ func installHandlers() {
 	handleThreshold("/sum_search", showSumQuery)
 	handleThreshold("/report_post_landing/", showReportLanding)
 	handleThreshold("/tags_autocomplete", getAutocomplete)
+	handleThreshold("/tags", showTagDirectory)
+	handleThreshold(apiPrefix+"cat/", showAPIQuery)
+	handleThreshold(apiPrefix+"t/", showAPIThread)
+	handleThreshold(apiPrefix+"p/", showAPIPost)
+	handleThreshold(apiPrefix+"tags", showAPITags)
+	handleThreshold(feedPrefix+"cat/", showQueryFeed)
+	handleThreshold(feedPrefix+"t/", showThreadFeed)
 
 	http.Handle("/ws_post/", websocket.Handler(threadUpdater))
 	http.HandleFunc("/robots.txt", showRobots)
 	http.HandleFunc("/th/", showThumbImage)
 	http.HandleFunc("/report_post", postReport)
 	http.HandleFunc("/post", postComment)
+	http.HandleFunc("/delete_post", postDeleteOwnPost)
 	http.HandleFunc("/new_thread", postThread)
 	http.HandleFunc("/admin_login", showAdminLogin)
 	http.HandleFunc("/admin_delete_thread/", showDeleteThread)
@@ -92,7 +118,17 @@ func installHandlers() {
 	http.HandleFunc("/admin_sticky_thread_landing/", showStickyLanding)
 	http.HandleFunc("/admin_sticky_thread", postSticky)
 	http.HandleFunc("/admin_rights", showAdminRights)
+	http.HandleFunc("/admin_socket_stats", showSocketStats)
+	http.HandleFunc("/admin_db_stats", showDumpStats)
 	http.HandleFunc("/posts_by_user/", postPostsByUser)
+	http.HandleFunc("/admin_bans", showBans)
+	http.HandleFunc("/admin_backup", postBackup)
+	http.HandleFunc("/admin_tag_rules", showTagRules)
+	http.HandleFunc("/admin_edit_tag_rule", postTagRule)
+	http.HandleFunc("/admin_edit_ban", postEditBan)
+	http.HandleFunc("/admin_revoke_ban", postRevokeBan)
+	http.HandleFunc("/admin_appeal_decision", postAppealDecision)
+	http.HandleFunc("/appeal_ban", postBanAppeal)
 }
 
 func parseTemplates() {
@@ -118,26 +154,44 @@ func main() {
 	log.Println("Starting Tolxanka.")
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	setConfiguration()
+	opts := setConfiguration()
 	log.Printf("Using configuration:\n%s\n", settings.String())
 
+	if opts.MigrateOnly {
+		initializeDatabase().Close()
+		log.Println("Database migration complete.")
+		return
+	}
+
 	parseTemplates()
 	staffSessions = initSessionStore()
-	db = initializeDatabase()
+	store = initializeDatabase()
 	initDbLoop()
 	mediaStore = newLibrary()
 	pageCache = newByteCache()
 	siteUsers = newUserMap()
-	signal.Notify(watchSignals())
+
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(settings.General.ListenPort),
+		Handler: context.ClearHandler(http.DefaultServeMux),
+	}
+
+	signals := make(chan os.Signal, 1)
+	watchSignals(signals, server)
+	signal.Notify(signals, syscall.SIGABRT, syscall.SIGINT, syscall.SIGTERM,
+		syscall.SIGUSR1)
 	initSequencer()
 	startFfmpegWorkers()
+	initBackupScheduler()
 	installHandlers()
 
 	log.Printf("Listening on port %d", settings.General.ListenPort)
 
-	port := ":" + strconv.Itoa(settings.General.ListenPort)
-	err := http.ListenAndServe(port, context.ClearHandler(http.DefaultServeMux))
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 	}
+
+	// Wait for shutdown to finish and exit.
+	select {}
 }
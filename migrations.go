@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// A single upgrade of the database schema, written out for each supported
+// dialect. Steps are applied in order. Add new steps to the end; never edit a
+// released one, since databases which already applied it won't see the
+// change.
+type migration struct {
+	Description string
+	SQLite      []string
+	Postgres    []string
+}
+
+// The schema version of a database is the number of migrations applied to it.
+// Databases created before versioning have no version table and start at
+// zero, which is why the early steps tolerate existing tables.
+var migrations = []migration{
+	{
+		Description: "Create threads, posts, media and bans",
+		SQLite: []string{
+			`CREATE TABLE IF NOT EXISTS threads(
+                id              TEXT PRIMARY KEY,
+                random_mark     INTEGER NOT NULL,
+                updated         INTEGER NOT NULL,
+                tags            TEXT NOT NULL,
+                sticky_tags     TEXT NOT NULL,
+                locked          INTEGER NOT NULL,
+                hidden          INTEGER NOT NULL);`,
+			`CREATE TABLE IF NOT EXISTS posts(
+                id              INTEGER PRIMARY KEY,
+                comment         TEXT NOT NULL,
+                user_addr       TEXT NOT NULL,
+                media           TEXT REFERENCES media(hash),
+                media_name      TEXT NOT NULL,
+                global_id       INTEGER NOT NULL,
+                local_id        INTEGER NOT NULL,
+                reply_to        INTEGER NOT NULL,
+                time            INTEGER NOT NULL,
+                parent_thread   TEXT REFERENCES threads(id) ON DELETE CASCADE,
+                hidden          INTEGER NOT NULL,
+                authority       TEXT NOT NULL);`,
+			`CREATE TABLE IF NOT EXISTS media(
+                hash            TEXT PRIMARY KEY,
+                thumb           TEXT NOT NULL,
+                type            TEXT NOT NULL,
+                info            TEXT NOT NULL,
+                size            INTEGER NOT NULL,
+                ban_reason      TEXT NOT NULL);`,
+			`CREATE TABLE IF NOT EXISTS bans(
+                id              INTEGER PRIMARY KEY,
+                user_addr       TEXT NOT NULL,
+                reason          TEXT NOT NULL,
+                description     TEXT NOT NULL,
+                start_time      INTEGER NOT NULL,
+                end_time        INTEGER NOT NULL);`,
+		},
+		// Referenced tables must exist before their foreign keys.
+		Postgres: []string{
+			`CREATE TABLE IF NOT EXISTS threads(
+                id              TEXT PRIMARY KEY,
+                random_mark     BIGINT NOT NULL,
+                updated         BIGINT NOT NULL,
+                tags            TEXT NOT NULL,
+                sticky_tags     TEXT NOT NULL,
+                locked          BOOLEAN NOT NULL,
+                hidden          BOOLEAN NOT NULL);`,
+			`CREATE TABLE IF NOT EXISTS media(
+                hash            TEXT PRIMARY KEY,
+                thumb           BYTEA NOT NULL,
+                type            TEXT NOT NULL,
+                info            TEXT NOT NULL,
+                size            BIGINT NOT NULL,
+                ban_reason      TEXT NOT NULL);`,
+			`CREATE TABLE IF NOT EXISTS posts(
+                id              BIGSERIAL PRIMARY KEY,
+                comment         TEXT NOT NULL,
+                user_addr       TEXT NOT NULL,
+                media           TEXT REFERENCES media(hash),
+                media_name      TEXT NOT NULL,
+                global_id       BIGINT NOT NULL,
+                local_id        BIGINT NOT NULL,
+                reply_to        BIGINT NOT NULL,
+                time            BIGINT NOT NULL,
+                parent_thread   TEXT REFERENCES threads(id) ON DELETE CASCADE,
+                hidden          BOOLEAN NOT NULL,
+                authority       TEXT NOT NULL);`,
+			`CREATE TABLE IF NOT EXISTS bans(
+                id              BIGSERIAL PRIMARY KEY,
+                user_addr       TEXT NOT NULL,
+                reason          TEXT NOT NULL,
+                description     TEXT NOT NULL,
+                start_time      BIGINT NOT NULL,
+                end_time        BIGINT NOT NULL);`,
+		},
+	},
+	{
+		Description: "Add ban revocations and appeals",
+		SQLite: []string{
+			`CREATE TABLE IF NOT EXISTS ban_revocations(
+                id              INTEGER PRIMARY KEY,
+                user_addr       TEXT NOT NULL,
+                start_time      INTEGER NOT NULL,
+                staff           TEXT NOT NULL,
+                reason          TEXT NOT NULL,
+                time            INTEGER NOT NULL);`,
+			`CREATE TABLE IF NOT EXISTS ban_appeals(
+                id              INTEGER PRIMARY KEY,
+                user_addr       TEXT NOT NULL,
+                start_time      INTEGER NOT NULL,
+                appeal          TEXT NOT NULL,
+                time            INTEGER NOT NULL,
+                status          TEXT NOT NULL,
+                staff           TEXT NOT NULL,
+                response        TEXT NOT NULL,
+                decision_time   INTEGER NOT NULL);`,
+		},
+		Postgres: []string{
+			`CREATE TABLE IF NOT EXISTS ban_revocations(
+                id              BIGSERIAL PRIMARY KEY,
+                user_addr       TEXT NOT NULL,
+                start_time      BIGINT NOT NULL,
+                staff           TEXT NOT NULL,
+                reason          TEXT NOT NULL,
+                time            BIGINT NOT NULL);`,
+			`CREATE TABLE IF NOT EXISTS ban_appeals(
+                id              BIGSERIAL PRIMARY KEY,
+                user_addr       TEXT NOT NULL,
+                start_time      BIGINT NOT NULL,
+                appeal          TEXT NOT NULL,
+                time            BIGINT NOT NULL,
+                status          TEXT NOT NULL,
+                staff           TEXT NOT NULL,
+                response        TEXT NOT NULL,
+                decision_time   BIGINT NOT NULL);`,
+		},
+	},
+	{
+		Description: "Add post reports",
+		SQLite: []string{
+			`CREATE TABLE IF NOT EXISTS reports(
+                id              INTEGER PRIMARY KEY,
+                parent_thread   TEXT REFERENCES threads(id) ON DELETE CASCADE,
+                local_id        INTEGER NOT NULL,
+                queue           TEXT NOT NULL,
+                user_addr       TEXT NOT NULL,
+                time            INTEGER NOT NULL);`,
+		},
+		Postgres: []string{
+			`CREATE TABLE IF NOT EXISTS reports(
+                id              BIGSERIAL PRIMARY KEY,
+                parent_thread   TEXT REFERENCES threads(id) ON DELETE CASCADE,
+                local_id        BIGINT NOT NULL,
+                queue           TEXT NOT NULL,
+                user_addr       TEXT NOT NULL,
+                time            BIGINT NOT NULL);`,
+		},
+	},
+	{
+		Description: "Add no-bump flag to posts",
+		SQLite: []string{
+			"ALTER TABLE posts ADD COLUMN no_bump INTEGER NOT NULL DEFAULT 0;",
+		},
+		Postgres: []string{
+			"ALTER TABLE posts ADD COLUMN no_bump BOOLEAN NOT NULL DEFAULT FALSE;",
+		},
+	},
+	{
+		Description: "Add tag alias and implication rules",
+		SQLite: []string{
+			`CREATE TABLE IF NOT EXISTS tag_rules(
+                id              INTEGER PRIMARY KEY,
+                kind            TEXT NOT NULL,
+                tag             TEXT NOT NULL,
+                target          TEXT NOT NULL);`,
+		},
+		Postgres: []string{
+			`CREATE TABLE IF NOT EXISTS tag_rules(
+                id              BIGSERIAL PRIMARY KEY,
+                kind            TEXT NOT NULL,
+                tag             TEXT NOT NULL,
+                target          TEXT NOT NULL);`,
+		},
+	},
+	{
+		Description: "Add SHA-256 hashes to media",
+		SQLite: []string{
+			"ALTER TABLE media ADD COLUMN sha256 TEXT NOT NULL DEFAULT '';",
+		},
+		Postgres: []string{
+			"ALTER TABLE media ADD COLUMN sha256 TEXT NOT NULL DEFAULT '';",
+		},
+	},
+	{
+		Description: "Add perceptual hashes to media",
+		SQLite: []string{
+			"ALTER TABLE media ADD COLUMN phash TEXT NOT NULL DEFAULT '';",
+		},
+		Postgres: []string{
+			"ALTER TABLE media ADD COLUMN phash TEXT NOT NULL DEFAULT '';",
+		},
+	},
+	{
+		Description: "Add upload MIME types to media",
+		SQLite: []string{
+			"ALTER TABLE media ADD COLUMN content_type TEXT NOT NULL DEFAULT '';",
+		},
+		Postgres: []string{
+			"ALTER TABLE media ADD COLUMN content_type TEXT NOT NULL DEFAULT '';",
+		},
+	},
+	{
+		Description: "Add deletion secrets to posts",
+		SQLite: []string{
+			"ALTER TABLE posts ADD COLUMN delete_secret TEXT NOT NULL DEFAULT '';",
+		},
+		Postgres: []string{
+			"ALTER TABLE posts ADD COLUMN delete_secret TEXT NOT NULL DEFAULT '';",
+		},
+	},
+}
+
+// Bring the database up to the latest schema version in one transaction.
+// Refuse to run against a schema newer than this binary knows about.
+func (s *sqlStorage) migrate() error {
+	return s.transaction(func(tx *sql.Tx) error {
+		cmd := "CREATE TABLE IF NOT EXISTS schema_version(version INTEGER NOT NULL);"
+		if _, e := tx.Exec(cmd); e != nil {
+			return e
+		}
+
+		var version int
+		row := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version;")
+		if e := row.Scan(&version); e != nil {
+			return e
+		}
+
+		if version > len(migrations) {
+			return fmt.Errorf("database schema version %d is newer than the "+
+				"latest known version %d", version, len(migrations))
+		}
+
+		if version == len(migrations) {
+			return nil
+		}
+
+		for i := version; i < len(migrations); i++ {
+			log.Printf("Migrating database to version %d: %s", i+1,
+				migrations[i].Description)
+			for _, cmd := range s.dialect.Schema(migrations[i]) {
+				if _, e := tx.Exec(cmd); e != nil {
+					return e
+				}
+			}
+		}
+
+		if _, e := tx.Exec("DELETE FROM schema_version;"); e != nil {
+			return e
+		}
+
+		cmd = s.dialect.Rebind("INSERT INTO schema_version (version) VALUES (?1);")
+		_, e := tx.Exec(cmd, len(migrations))
+		return e
+	})
+}
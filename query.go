@@ -0,0 +1,443 @@
+/*
+query.go
+
+Parses tag queries into expressions and evaluates them against the tag
+lists. The grammar, loosest binding first:
+
+	expr := seq { "OR" seq }
+	seq  := item { ["AND"] item }
+	item := ("+" | "-" | "NOT") atom | atom
+	atom := TAG | "(" expr ")"
+
+Items of a sequence keep the meaning of the original query syntax: bare
+items must all match, "+" items are merged in as alternatives, and "-" or
+NOT items are excluded from the result. So "a b +c -d" is
+((a AND b) OR c) AND NOT d.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tagExpr interface {
+	// Whether the thread satisfies the expression.
+	Match(pile tagMap, t *thread) bool
+
+	// Tags whose threads include every possible match. If all is true,
+	// any thread may match.
+	Candidates(pile tagMap) (tags tagList, all bool)
+
+	String() string
+}
+
+// A single tag, matching threads in its normal thread list.
+type tagTerm string
+
+func (tt tagTerm) Match(pile tagMap, t *thread) bool {
+	tag, ok := pile[string(tt)]
+	if !ok {
+		return false
+	}
+
+	_, ok = tag.Normal.Elems[t]
+	return ok
+}
+
+func (tt tagTerm) Candidates(pile tagMap) (tagList, bool) {
+	return pile.Lookup([]string{string(tt)}), false
+}
+
+func (tt tagTerm) String() string {
+	return string(tt)
+}
+
+// Alternatives joined by OR.
+type orExpr []tagExpr
+
+func (oe orExpr) Match(pile tagMap, t *thread) bool {
+	for _, x := range oe {
+		if x.Match(pile, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (oe orExpr) Candidates(pile tagMap) (tagList, bool) {
+	out := tagList{}
+	for _, x := range oe {
+		tags, all := x.Candidates(pile)
+		if all {
+			return nil, true
+		}
+		out = append(out, tags...)
+	}
+	return out, false
+}
+
+func (oe orExpr) String() string {
+	parts := []string{}
+	for _, x := range oe {
+		parts = append(parts, x.String())
+	}
+	return "(" + strings.Join(parts, " OR ") + ")"
+}
+
+// A sequence of items with the original query semantics.
+type seqExpr struct {
+	Filters  []tagExpr
+	Merges   []tagExpr
+	Excludes []tagExpr
+}
+
+func (se *seqExpr) Match(pile tagMap, t *thread) bool {
+	matched := len(se.Filters) == 0 && len(se.Merges) == 0
+
+	if len(se.Filters) > 0 {
+		matched = true
+		for _, x := range se.Filters {
+			if !x.Match(pile, t) {
+				matched = false
+				break
+			}
+		}
+	}
+
+	for _, x := range se.Merges {
+		if matched {
+			break
+		}
+		matched = x.Match(pile, t)
+	}
+
+	if !matched {
+		return false
+	}
+
+	for _, x := range se.Excludes {
+		if x.Match(pile, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Any match of the filters is a match of each filter, so only the filter
+// with the fewest candidate threads needs searching.
+func (se *seqExpr) Candidates(pile tagMap) (tagList, bool) {
+	if len(se.Filters) == 0 && len(se.Merges) == 0 {
+		return nil, true
+	}
+
+	var out tagList
+	if len(se.Filters) > 0 {
+		best, bestCount, all := tagList{}, uint(0), true
+		for _, x := range se.Filters {
+			tags, xAll := x.Candidates(pile)
+			if xAll {
+				continue
+			}
+
+			var count uint
+			for _, tag := range tags {
+				count += tag.Normal.Count
+			}
+
+			if all || count < bestCount {
+				best, bestCount, all = tags, count, false
+			}
+		}
+
+		if all {
+			return nil, true
+		}
+		out = append(out, best...)
+	}
+
+	for _, x := range se.Merges {
+		tags, all := x.Candidates(pile)
+		if all {
+			return nil, true
+		}
+		out = append(out, tags...)
+	}
+
+	return out, false
+}
+
+func (se *seqExpr) String() string {
+	parts := []string{}
+	for _, x := range se.Filters {
+		parts = append(parts, x.String())
+	}
+	for _, x := range se.Merges {
+		parts = append(parts, "+"+x.String())
+	}
+	for _, x := range se.Excludes {
+		parts = append(parts, "-"+x.String())
+	}
+
+	if len(parts) == 1 && len(se.Filters) == 1 {
+		return parts[0]
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// Names of the plain tags directly in a sequence, by their role. Used for
+// showing simple queries.
+func (se *seqExpr) plainTags() (filter, merge, exclude []string) {
+	names := func(xs []tagExpr) []string {
+		out := []string{}
+		for _, x := range xs {
+			if tt, ok := x.(tagTerm); ok {
+				out = append(out, string(tt))
+			}
+		}
+		return out
+	}
+
+	return names(se.Filters), names(se.Merges), names(se.Excludes)
+}
+
+// Whether the sequence is expressible in the original query syntax.
+func (se *seqExpr) isPlain() bool {
+	f, m, e := se.plainTags()
+	return len(f)+len(m)+len(e) ==
+		len(se.Filters)+len(se.Merges)+len(se.Excludes)
+}
+
+// Tags the expression asks for, leaving out excluded ones. Used to find
+// sticky threads for a query.
+func positiveTags(x tagExpr) []string {
+	out := []string{}
+	switch x := x.(type) {
+	case tagTerm:
+		out = append(out, string(x))
+	case orExpr:
+		for _, y := range x {
+			out = append(out, positiveTags(y)...)
+		}
+	case *seqExpr:
+		for _, y := range x.Filters {
+			out = append(out, positiveTags(y)...)
+		}
+		for _, y := range x.Merges {
+			out = append(out, positiveTags(y)...)
+		}
+	}
+	return out
+}
+
+// Copy an expression with each tag passed through rename.
+func renameTags(x tagExpr, rename func(string) string) tagExpr {
+	renameAll := func(xs []tagExpr) []tagExpr {
+		out := []tagExpr{}
+		for _, y := range xs {
+			out = append(out, renameTags(y, rename))
+		}
+		return out
+	}
+
+	switch x := x.(type) {
+	case tagTerm:
+		return tagTerm(rename(string(x)))
+	case orExpr:
+		return orExpr(renameAll(x))
+	case *seqExpr:
+		return &seqExpr{
+			Filters:  renameAll(x.Filters),
+			Merges:   renameAll(x.Merges),
+			Excludes: renameAll(x.Excludes),
+		}
+	}
+	return x
+}
+
+// Wrap an expression so it never matches threads with the tag.
+func excludeTag(x tagExpr, tag string) tagExpr {
+	switch x := x.(type) {
+	case nil:
+		return nil
+	case *seqExpr:
+		out := *x
+		out.Excludes = append(append([]tagExpr{}, x.Excludes...), tagTerm(tag))
+		return &out
+	}
+
+	return &seqExpr{
+		Filters:  []tagExpr{x},
+		Excludes: []tagExpr{tagTerm(tag)},
+	}
+}
+
+type queryParser struct {
+	tokens []string
+	pos    int
+	allow  func(tag string) error
+}
+
+// Parse a query into an expression. Returns nil for an empty query. Each tag
+// is checked with allow, which may reject it with an error.
+func parseTagQuery(query string, allow func(string) error) (tagExpr, error) {
+	qp := &queryParser{tokens: lexTagQuery(query), allow: allow}
+	if len(qp.tokens) == 0 {
+		return nil, nil
+	}
+
+	x, e := qp.expr()
+	if e != nil {
+		return nil, e
+	}
+
+	if tok := qp.peek(); tok != "" {
+		if tok == ")" {
+			return nil, errors.New("unmatched closing parenthesis")
+		}
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return x, nil
+}
+
+// Split a query into words, parentheses and leading + or - prefixes.
+func lexTagQuery(query string) []string {
+	tokens := []string{}
+	word := []rune{}
+
+	flush := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+
+	for _, r := range query {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case (r == '+' || r == '-') && len(word) == 0:
+			tokens = append(tokens, string(r))
+		default:
+			word = append(word, r)
+		}
+	}
+
+	flush()
+	return tokens
+}
+
+func (qp *queryParser) peek() string {
+	if qp.pos < len(qp.tokens) {
+		return qp.tokens[qp.pos]
+	}
+	return ""
+}
+
+func (qp *queryParser) next() string {
+	tok := qp.peek()
+	qp.pos++
+	return tok
+}
+
+func (qp *queryParser) expr() (tagExpr, error) {
+	alternatives := orExpr{}
+	for {
+		x, e := qp.seq()
+		if e != nil {
+			return nil, e
+		}
+		alternatives = append(alternatives, x)
+
+		if qp.peek() != "OR" {
+			break
+		}
+		qp.next()
+	}
+
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return alternatives, nil
+}
+
+func (qp *queryParser) seq() (tagExpr, error) {
+	se := &seqExpr{}
+	for {
+		switch qp.peek() {
+		case "", ")", "OR":
+			if len(se.Filters)+len(se.Merges)+len(se.Excludes) == 0 {
+				return nil, qp.missing("a tag or group")
+			}
+			return se, nil
+		case "AND":
+			if len(se.Filters)+len(se.Merges)+len(se.Excludes) == 0 {
+				return nil, qp.missing("a tag or group")
+			}
+			qp.next()
+			if tok := qp.peek(); tok == "" || tok == ")" || tok == "OR" ||
+				tok == "AND" {
+				return nil, qp.missing("a tag or group after AND")
+			}
+		}
+
+		if e := qp.item(se); e != nil {
+			return nil, e
+		}
+	}
+}
+
+func (qp *queryParser) item(se *seqExpr) error {
+	list := &se.Filters
+	switch op := qp.peek(); op {
+	case "+":
+		list = &se.Merges
+		qp.next()
+	case "-", "NOT":
+		list = &se.Excludes
+		qp.next()
+	}
+
+	x, e := qp.atom()
+	if e != nil {
+		return e
+	}
+
+	*list = append(*list, x)
+	return nil
+}
+
+func (qp *queryParser) atom() (tagExpr, error) {
+	switch tok := qp.peek(); tok {
+	case "(":
+		qp.next()
+		x, e := qp.expr()
+		if e != nil {
+			return nil, e
+		}
+		if qp.next() != ")" {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		return x, nil
+	case "", ")", "+", "-", "AND", "OR", "NOT":
+		return nil, qp.missing("a tag or group")
+	default:
+		qp.next()
+		if e := qp.allow(tok); e != nil {
+			return nil, e
+		}
+		return tagTerm(tok), nil
+	}
+}
+
+func (qp *queryParser) missing(what string) error {
+	if tok := qp.peek(); tok != "" {
+		return fmt.Errorf("expected %s before %q", what, tok)
+	}
+	return fmt.Errorf("expected %s at end of query", what)
+}
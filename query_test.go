@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func allowAll(string) error { return nil }
+
+func TestLexTagQuery(t *testing.T) {
+	cases := []struct {
+		query  string
+		tokens []string
+	}{
+		{"", []string{}},
+		{"a b", []string{"a", "b"}},
+		{"  a\tb  ", []string{"a", "b"}},
+		{"+a -b", []string{"+", "a", "-", "b"}},
+		{"a-b x+y", []string{"a-b", "x+y"}},
+		{"(a OR b)c", []string{"(", "a", "OR", "b", ")", "c"}},
+		{"-(a)", []string{"-", "(", "a", ")"}},
+	}
+
+	for _, c := range cases {
+		if got := lexTagQuery(c.query); !reflect.DeepEqual(got, c.tokens) {
+			t.Errorf("lexTagQuery(%q) = %q, want %q", c.query, got, c.tokens)
+		}
+	}
+}
+
+func TestParseTagQuery(t *testing.T) {
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"a", "a"},
+		{"((a))", "a"},
+		{"a b", "(a b)"},
+		{"a AND b", "(a b)"},
+		{"a OR b", "(a OR b)"},
+		{"a b OR c", "((a b) OR c)"},
+		{"a OR b c", "(a OR (b c))"},
+		{"a (b OR c)", "(a (b OR c))"},
+		{"a +b", "(a +b)"},
+		{"a -b", "(a -b)"},
+		{"a NOT b", "(a -b)"},
+		{"NOT a", "(-a)"},
+		{"-(a OR b) c", "(c -(a OR b))"},
+		{"a b +c -d", "(a b +c -d)"},
+	}
+
+	for _, c := range cases {
+		x, e := parseTagQuery(c.query, allowAll)
+		if e != nil {
+			t.Errorf("parseTagQuery(%q) failed: %s", c.query, e)
+			continue
+		}
+		if got := x.String(); got != c.want {
+			t.Errorf("parseTagQuery(%q) = %s, want %s", c.query, got, c.want)
+		}
+	}
+}
+
+func TestParseTagQueryErrors(t *testing.T) {
+	cases := []struct {
+		query string
+		err   string
+	}{
+		{"(a", "missing closing parenthesis"},
+		{"a)", "unmatched closing parenthesis"},
+		{"a OR", "expected a tag or group at end of query"},
+		{"OR a", `expected a tag or group before "OR"`},
+		{"AND a", `expected a tag or group before "AND"`},
+		{"a AND OR b", `expected a tag or group after AND before "OR"`},
+		{"a AND", "expected a tag or group after AND at end of query"},
+		{"a -", "expected a tag or group at end of query"},
+		{"()", `expected a tag or group before ")"`},
+		{"a secret", "tag not allowed"},
+	}
+
+	allow := func(tag string) error {
+		if tag == "secret" {
+			return errors.New("tag not allowed")
+		}
+		return nil
+	}
+
+	for _, c := range cases {
+		x, e := parseTagQuery(c.query, allow)
+		if e == nil {
+			t.Errorf("parseTagQuery(%q) = %s, want error %q", c.query, x, c.err)
+		} else if e.Error() != c.err {
+			t.Errorf("parseTagQuery(%q) error %q, want %q", c.query, e, c.err)
+		}
+	}
+
+	if x, e := parseTagQuery("   ", allowAll); x != nil || e != nil {
+		t.Errorf("parseTagQuery of a blank query = %v, %v, want nil, nil", x, e)
+	}
+}
+
+func TestTagExprMatch(t *testing.T) {
+	pile := tagMap{}
+	threads := map[string][]string{
+		"t1": {"a", "b"},
+		"t2": {"a"},
+		"t3": {"c"},
+		"t4": {"b", "c"},
+	}
+
+	all := []*thread{}
+	for id, tags := range threads {
+		th := &thread{Id: threadId(id)}
+		for _, name := range tags {
+			if pile[name] == nil {
+				pile[name] = newTag(name)
+			}
+			pile[name].AddThread(th)
+		}
+		all = append(all, th)
+	}
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"a", []string{"t1", "t2"}},
+		{"a b", []string{"t1"}},
+		{"a OR c", []string{"t1", "t2", "t3", "t4"}},
+		{"a -b", []string{"t2"}},
+		{"a +c", []string{"t1", "t2", "t3", "t4"}},
+		{"a b +c -d", []string{"t1", "t3", "t4"}},
+		{"(a OR c) NOT b", []string{"t2", "t3"}},
+		{"NOT a", []string{"t3", "t4"}},
+		{"c (a OR b)", []string{"t4"}},
+		{"a b OR c -b", []string{"t1", "t3"}},
+		{"missing", []string{}},
+	}
+
+	for _, c := range cases {
+		x, e := parseTagQuery(c.query, allowAll)
+		if e != nil {
+			t.Errorf("parseTagQuery(%q) failed: %s", c.query, e)
+			continue
+		}
+
+		got := []string{}
+		for _, th := range all {
+			if x.Match(pile, th) {
+				got = append(got, string(th.Id))
+			}
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q matched %v, want %v", c.query, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Inverted index of words in post comments, kept current by the hive.
+type commentIndex map[string]map[*post]bool
+
+// Split text into lowercase words, dropping punctuation.
+func commentWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func (ci commentIndex) Add(p *post) {
+	for _, word := range commentWords(p.Comment) {
+		if ci[word] == nil {
+			ci[word] = map[*post]bool{}
+		}
+		ci[word][p] = true
+	}
+}
+
+func (ci commentIndex) Remove(p *post) {
+	for _, word := range commentWords(p.Comment) {
+		delete(ci[word], p)
+		if len(ci[word]) == 0 {
+			delete(ci, word)
+		}
+	}
+}
+
+// Threads with a visible post containing every one of the words.
+func (ci commentIndex) Threads(words []string) map[threadId]bool {
+	out := map[threadId]bool{}
+	if len(words) == 0 {
+		return out
+	}
+
+	// Check candidates from the rarest word against the rest.
+	rarest := ci[words[0]]
+	for _, word := range words[1:] {
+		if len(ci[word]) < len(rarest) {
+			rarest = ci[word]
+		}
+	}
+
+	for p := range rarest {
+		if p.Hidden || out[p.ParentThread] {
+			continue
+		}
+
+		matched := true
+		for _, word := range words {
+			if !ci[word][p] {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			out[p.ParentThread] = true
+		}
+	}
+
+	return out
+}
@@ -9,16 +9,9 @@
 package main
 
 import (
-	"golang.org/x/net/websocket"
 	"log"
 )
 
-type wsRegistration struct {
-	Thread threadId
-	Done   chan bool
-	Sock   *websocket.Conn
-}
-
 type threadReq struct {
 	Thread threadId
 	Out    chan []byte
@@ -26,7 +19,7 @@ type threadReq struct {
 
 type hiveCmd func(*hive)
 
-var regListener chan wsRegistration
+var regListener chan *wsRegistration
 var threadRequest chan threadReq
 var hiveReqListener chan hiveCmd
 
@@ -41,7 +34,7 @@ func hiveReq(f hiveCmd) {
 }
 
 func initSequencer() {
-	regListener = make(chan wsRegistration, 100)
+	regListener = make(chan *wsRegistration, 100)
 	threadRequest = make(chan threadReq, 100)
 	hiveReqListener = make(chan hiveCmd, 100)
 
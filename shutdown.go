@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Stop accepting requests, let in-flight requests and queued hive commands
+// finish, then flush the persistence queues and close the database. If this
+// takes longer than ShutdownTimeout, exit regardless.
+func shutdown(server *http.Server) {
+	log.Println("Shutting down.")
+	timeout := settings.General.ShutdownTimeout.Duration
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan bool)
+	go func() {
+		closeAllListeners(timeout / 2)
+
+		if e := server.Shutdown(ctx); e != nil {
+			log.Println("Error shutting down http server: " + e.Error())
+		}
+
+		// Commands already queued are run before this one.
+		hiveReq(func(h *hive) {})
+
+		dumpAll()
+		if e := store.Close(); e != nil {
+			log.Println("Error closing database: " + e.Error())
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		log.Println("Shutdown complete.")
+	case <-ctx.Done():
+		log.Println("Shutdown timed out; exiting with unsaved data.")
+		os.Exit(1)
+	}
+}
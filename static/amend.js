@@ -34,6 +34,18 @@ function amendFooter(modPostOption) {
         adminSection += '<a href="/cat/!%3F_admin">!?_admin</a> ';
     }
 
+    if (adminRights.ManageBans) {
+        adminSection += '<a href="/admin_bans">Bans</a> ';
+    }
+
+    if (adminRights.ManageTags) {
+        adminSection += '<a href="/admin_tag_rules">Tag rules</a> ';
+    }
+
+    if (adminRights.RunBackups) {
+        adminSection += '<button form="admin_section" formaction="/admin_backup" type="submit">Backup</button> ';
+    }
+
     if (modPostOption && adminRights.DeletePost && adminRights.BanUser) {
         adminSection += '<button form="admin_section" id="mod_posts" type="submit">Mod Posts</button>' +
                           '<a href="#" id="select_all_posts">Select All</a>';
@@ -71,6 +71,31 @@ function addRowHandlers(row) {
     qsael(row, "a.fold_posts",      "mouseover",    highlightFold);
     qsael(row, "a.fold_posts",      "mouseout",     unhighlightNotifier);
     addThumbHandler(row);
+    addDeleteControl(row);
+}
+
+function addDeleteControl(row) {
+    var gid = row.getAttribute("data-post_gid");
+    if (global.pageType != "thread" || !readCookie("delete_" + gid)) { return }
+
+    var html = '<a href="#" class="side_control delete_post">×</a>';
+    qs(row, "div.action_indicator").insertAdjacentHTML("afterEnd", html);
+    qsael(row, "a.delete_post", "click",     deleteOwnPost);
+    qsael(row, "a.delete_post", "mouseover", highlightDelete);
+    qsael(row, "a.delete_post", "mouseout",  unhighlightNotifier);
+}
+
+function deleteOwnPost(e) {
+    haltEvent(e);
+    var gid = this.parentNode.getAttribute("data-post_gid");
+    var postData = new FormData();
+    postData.append("gid", gid);
+    postData.append("no_redirect", "true");
+
+    var xhr = new XMLHttpRequest();
+    xhr.addEventListener("load", displayPostResponse, false);
+    xhr.open("POST", "/delete_post", true);
+    xhr.send(postData);
 }
 
 function addThumbHandler(row) {
@@ -218,6 +243,10 @@ function highlightReport() {
     showRowNotifier(this.parentNode, "REPORT", "#dc9190", "black");
 }
 
+function highlightDelete() {
+    showRowNotifier(this.parentNode, "DELETE", "#dc9190", "black");
+}
+
 function highlightFold() {
     showRowNotifier(this.parentNode, "FOLD", "#cbc0dc", "black");
 }
@@ -660,17 +689,97 @@ function mapFormFields(f) {
 
 function openPostingSocket() {
     var threadId = global.tdiv.getAttribute("data-thread_id");
-    var ws = new WebSocket("ws://" + location.host + "/ws_post/" + threadId);
+    var url = "ws://" + location.host + "/ws_post/" + threadId + "?protocol=events";
+    var ws = new WebSocket(url);
     if (ws) {
-        ws.addEventListener("message", insertPost, false);
+        ws.addEventListener("message", receiveUpdate, false);
+        global.socket = ws;
+    }
+}
+
+function receiveUpdate(e) {
+    var ev = JSON.parse(e.data);
+    var handler = {
+        "ping":             answerPing,
+        "post_added":       insertPost,
+        "post_hidden":      removePost,
+        "reply_bound":      bindReply,
+        "thread_locked":    setThreadLocked,
+        "thread_stickied":  setThreadSticky,
+        "thread_deleted":   announceThreadDeleted,
+        "server_shutdown":  announceShutdown
+    }[ev.type];
+
+    if (handler) { handler(ev) }
+}
+
+function answerPing(ev) {
+    global.socket.send(JSON.stringify({"type": "pong"}));
+}
+
+function removePost(ev) {
+    var row = rowByLid(ev.lid);
+    if (row) {
+        row.parentNode.removeChild(row);
+    }
+}
+
+function bindReply(ev) {
+    var target = rowByLid(ev.target);
+    if (target) {
+        annotateReplyTarget(target, ev.lid);
     }
 }
 
-function insertPost(e) {
+function setThreadLocked(ev) {
+    global.tdiv.setAttribute("data-locked", ev.locked ? "true" : "false");
+    if (adminRights.PostInLockedThread) { return }
+
+    var footer = qs(document, "footer#thread_footer");
+    var lockedMsg = qs(footer, "h3.locked_msg");
+
+    if (ev.locked && !lockedMsg) {
+        footer.insertAdjacentHTML("afterbegin", '<h3 class="locked_msg">Thread is locked.</h3>');
+    } else if (!ev.locked && lockedMsg) {
+        footer.removeChild(lockedMsg);
+    }
+
+    var display = ev.locked ? "none" : null;
+    qs(footer, "div#footer_left").style.display = display;
+    qs(footer, "div#footer_right").style.display = display;
+}
+
+function setThreadSticky(ev) {
+    var tags = ev.sticky_tags || [];
+    global.tdiv.setAttribute("data-sticky_tags", tags.join(" "));
+
+    var footer = qs(document, "footer#thread_footer");
+    var stickyMsg = qs(footer, "h3.sticky_msg");
+    if (stickyMsg) {
+        footer.removeChild(stickyMsg);
+    }
+
+    if (tags.length > 0) {
+        var msg = document.createElement("h3");
+        msg.className = "sticky_msg";
+        msg.textContent = "Sticky in: " + tags.join(", ");
+        footer.insertBefore(msg, qs(footer, "div#footer_left"));
+    }
+}
+
+function announceThreadDeleted(ev) {
+    writeToMsgDisplay("This thread has been deleted.");
+    qs(document, "form#add_post").style.display = "none";
+}
+
+function announceShutdown(ev) {
+    writeToMsgDisplay("The server is restarting. Reload to see new posts.");
+}
+
+function insertPost(ev) {
     var stayDown = elementInViewport(qs(document, "footer"));
-    global.tdiv.insertAdjacentHTML("beforeEnd", e.data);
+    global.tdiv.insertAdjacentHTML("beforeEnd", ev.html);
     var insertedPost = getLatestPost();
-    bindReplyToTarget(insertedPost);
     decorateRow(insertedPost);
     announcePost(insertedPost);
     recoverUserHan();
@@ -695,17 +804,6 @@ function announcePost(row) {
     document.dispatchEvent(announcePost);
 }
 
-function bindReplyToTarget(row) {
-    var targetId = qs(row, "a.reply_target").textContent.trim();
-
-    if (!targetId) {
-        return;
-    }
-
-    var postNo = row.getAttribute("data-post_lid");
-    annotateReplyTarget(rowByLid(targetId), postNo);
-}
-
 function hiddenByFold(row) {
     var postNo = row.getAttribute("data-post_lid");
     var activeFold = qs(document, "article.post_row[data-pivot='true']")
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Everything the board persists goes through a storage backend. Batched
+// writes run in a single transaction; a failing row is skipped without
+// aborting the rest of the batch, and reported in a *batchError once the
+// others are committed. Read methods are only used during recovery and call
+// back once per stored record. Atomic runs a group of writes in one
+// transaction instead, committed only if f returns nil.
+type storage interface {
+	Close() error
+	Backup(dest string) error
+	Atomic(f func(st storage) error) error
+
+	InsertThreads(threads []*thread) error
+	InsertPosts(posts []*post) error
+	InsertMedia(ms []*media) error
+	InsertBans(bans []*userBan) error
+	InsertReports(reports []reportEntry) error
+	UpdateThreadStates(states []threadState) error
+	UpdatePostStates(states []postState) error
+
+	UpdateThreadTags(t *thread) error
+	DeleteThread(tid threadId) error
+	BlockMedia(i *media) error
+	UpdateMediaSHA256(i *media) error
+	UpdateMediaThumb(i *media) error
+	UpdateMediaPHash(i *media) error
+	UpdateBanEnd(b *userBan) error
+	InsertBanRevocation(b *userBan) error
+	InsertBanAppeal(b *userBan) error
+	UpdateBanAppeal(b *userBan) error
+	InsertTagRule(r tagRule) error
+	DeleteTagRule(r tagRule) error
+
+	ReadThreads(newThread func() *thread, each func(*thread)) error
+	ReadPosts(each func(p *post, mediaHash *string)) error
+	ReadMedia(each func(i *media, banReason string)) error
+	ReadBans(each func(*userBan)) error
+	ReadBanRevocations(each func(addr string, start int64, r *banRevocation)) error
+	ReadBanAppeals(each func(addr string, start int64, a *banAppeal)) error
+	ReadReports(each func(reportEntry)) error
+	ReadTagRules(each func(tagRule)) error
+}
+
+// Open the backend selected in the [Database] section and bring its schema
+// up to date.
+func openStorage(conf dbConf) (storage, error) {
+	switch conf.Backend {
+	case "", "sqlite":
+		return newSQLStorage(sqliteDialect, conf.Name)
+	case "postgres":
+		return newSQLStorage(postgresDialect, conf.Name)
+	}
+
+	return nil, errors.New("unknown database backend: " + conf.Backend)
+}
+
+// Rows of a committed batch which could not be written, by batch index.
+type batchError struct {
+	Failed map[int]error
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("%d rows of batch failed", len(e.Failed))
+}
+
+// The differences between SQL databases that the board cares about. Queries
+// are written with SQLite style ?N placeholders and rebound for the target.
+type sqlDialect struct {
+	Driver string
+	Init   []string // Run once after connecting.
+	Rebind func(query string) string
+	Schema func(m migration) []string
+	Backup func(db *sql.DB, dest string) error // nil if unsupported.
+}
+
+// Statements run either directly on the database or in a transaction.
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// A storage backend on top of database/sql, shared by every SQL dialect.
+type sqlStorage struct {
+	db      *sql.DB
+	tx      *sql.Tx // Set on the copy handed out by Atomic.
+	dialect sqlDialect
+
+	insertThread, insertPost, insertMedia, insertBan *sql.Stmt
+	insertReport, updateThread, updatePost           *sql.Stmt
+}
+
+func newSQLStorage(d sqlDialect, source string) (*sqlStorage, error) {
+	db, e := sql.Open(d.Driver, source)
+	if e != nil {
+		return nil, e
+	}
+
+	s := &sqlStorage{db: db, dialect: d}
+	for _, cmd := range d.Init {
+		if _, e := db.Exec(cmd); e != nil {
+			return nil, e
+		}
+	}
+
+	if e := s.migrate(); e != nil {
+		return nil, e
+	}
+
+	return s, s.prepareStatements()
+}
+
+func (s *sqlStorage) prepareStatements() (e error) {
+	prepare := func(cmd string) *sql.Stmt {
+		if e != nil {
+			return nil
+		}
+
+		var stmt *sql.Stmt
+		stmt, e = s.db.Prepare(s.dialect.Rebind(cmd))
+		return stmt
+	}
+
+	s.insertThread = prepare(
+		"INSERT INTO threads " +
+			"(id, random_mark, updated, tags, sticky_tags, locked, hidden) " +
+			"VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7);")
+
+	s.insertPost = prepare(
+		"INSERT INTO posts " +
+			"(comment, user_addr, media, media_name, global_id, local_id, reply_to, " +
+			"time, parent_thread, hidden, authority, no_bump, delete_secret) " +
+			"VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13);")
+
+	s.insertMedia = prepare(
+		"INSERT INTO media " +
+			"(hash, thumb, type, info, size, ban_reason, sha256, phash, " +
+			"content_type) VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9);")
+
+	s.insertBan = prepare(
+		"INSERT INTO bans " +
+			"(user_addr, reason, description, start_time, end_time) " +
+			"VALUES (?1, ?2, ?3, ?4, ?5);")
+
+	s.insertReport = prepare(
+		"INSERT INTO reports " +
+			"(parent_thread, local_id, queue, user_addr, time) " +
+			"VALUES (?1, ?2, ?3, ?4, ?5);")
+
+	s.updateThread = prepare(
+		"UPDATE threads SET locked = ?1, hidden = ?2 WHERE id = ?3;")
+
+	s.updatePost = prepare(
+		"UPDATE posts SET hidden = ?1 " +
+			"WHERE parent_thread = ?2 AND local_id = ?3;")
+
+	return e
+}
+
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStorage) Backup(dest string) error {
+	if s.dialect.Backup == nil {
+		return errors.New("online backups are not supported by the " +
+			s.dialect.Driver + " backend")
+	}
+
+	return s.dialect.Backup(s.db, dest)
+}
+
+func (s *sqlStorage) Atomic(f func(st storage) error) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		inner := *s
+		inner.tx = tx
+		return f(&inner)
+	})
+}
+
+// Run f in a new transaction, or in the enclosing one inside Atomic.
+func (s *sqlStorage) transaction(f func(tx *sql.Tx) error) error {
+	if s.tx != nil {
+		return f(s.tx)
+	}
+
+	tx, e := s.db.Begin()
+	if e != nil {
+		return e
+	}
+
+	if e := f(tx); e != nil {
+		tx.Rollback()
+		return e
+	}
+
+	return tx.Commit()
+}
+
+// Run stmt once per row of a batch inside one transaction. Each row gets its
+// own savepoint, since PostgreSQL refuses further statements in a
+// transaction after any of them fails.
+func (s *sqlStorage) batch(stmt *sql.Stmt, n int,
+	args func(i int) []interface{}) error {
+
+	if n == 0 {
+		return nil
+	}
+
+	failed := map[int]error{}
+	e := s.transaction(func(tx *sql.Tx) error {
+		txStmt := tx.Stmt(stmt)
+		for i := 0; i < n; i++ {
+			if _, e := tx.Exec("SAVEPOINT dump_row;"); e != nil {
+				return e
+			}
+
+			if _, e := txStmt.Exec(args(i)...); e != nil {
+				failed[i] = e
+				if _, e := tx.Exec("ROLLBACK TO SAVEPOINT dump_row;"); e != nil {
+					return e
+				}
+			}
+
+			if _, e := tx.Exec("RELEASE SAVEPOINT dump_row;"); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+
+	if e == nil && len(failed) > 0 {
+		return &batchError{failed}
+	}
+	return e
+}
+
+func (s *sqlStorage) conn() sqlConn {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+func (s *sqlStorage) exec(query string, args ...interface{}) error {
+	_, e := s.conn().Exec(s.dialect.Rebind(query), args...)
+	return e
+}
+
+func (s *sqlStorage) query(query string, each func(*sql.Rows) error) error {
+	rows, e := s.conn().Query(s.dialect.Rebind(query))
+	if e != nil {
+		return e
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if e := each(rows); e != nil {
+			return e
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *sqlStorage) InsertThreads(threads []*thread) error {
+	return s.batch(s.insertThread, len(threads), func(i int) []interface{} {
+		t := threads[i]
+		return []interface{}{
+			string(t.Id), t.RandomMark, t.Updated.Unix(),
+			strings.Join(t.Tags, " "), strings.Join(t.StickyTags, " "),
+			t.Locked, t.Hidden}
+	})
+}
+
+func (s *sqlStorage) InsertPosts(posts []*post) error {
+	return s.batch(s.insertPost, len(posts), func(i int) []interface{} {
+		p := posts[i]
+		var imgHash *string
+		var role string
+
+		if p.Media != nil {
+			imgHash = &p.Media.Hash
+		}
+
+		if p.ShowRole {
+			role = p.RoleName
+		}
+
+		return []interface{}{
+			p.Comment, p.UserAddr, imgHash, p.MediaName, p.GlobalId,
+			p.LocalId, p.ReplyTo, p.Time.Unix(), string(p.ParentThread),
+			p.Hidden, role, p.NoBump, p.DeleteSecret}
+	})
+}
+
+func (s *sqlStorage) InsertMedia(ms []*media) error {
+	return s.batch(s.insertMedia, len(ms), func(n int) []interface{} {
+		i := ms[n]
+		var banReason string
+		if i.Blocked != nil {
+			banReason = i.Blocked.Name
+		}
+
+		return []interface{}{i.Hash, i.Thumb, i.MediaType, i.InfoString,
+			i.Size, banReason, i.SHA256, i.PHash, i.ContentType}
+	})
+}
+
+func (s *sqlStorage) InsertBans(bans []*userBan) error {
+	return s.batch(s.insertBan, len(bans), func(i int) []interface{} {
+		b := bans[i]
+		return []interface{}{b.Addr, b.Reason.Name, b.Reason.Description,
+			b.Start.Unix(), b.End.Unix()}
+	})
+}
+
+func (s *sqlStorage) InsertReports(reports []reportEntry) error {
+	return s.batch(s.insertReport, len(reports), func(i int) []interface{} {
+		r := reports[i]
+		return []interface{}{string(r.Thread), r.Lid, r.Queue,
+			r.SubmitterAddr, r.Time.Unix()}
+	})
+}
+
+func (s *sqlStorage) UpdateThreadStates(states []threadState) error {
+	return s.batch(s.updateThread, len(states), func(i int) []interface{} {
+		t := states[i]
+		return []interface{}{t.Locked, t.Hidden, string(t.Id)}
+	})
+}
+
+func (s *sqlStorage) UpdatePostStates(states []postState) error {
+	return s.batch(s.updatePost, len(states), func(i int) []interface{} {
+		p := states[i]
+		return []interface{}{p.Hidden, string(p.Thread), p.Lid}
+	})
+}
+
+func (s *sqlStorage) UpdateThreadTags(t *thread) error {
+	return s.exec("UPDATE threads SET tags = ?1, sticky_tags = ?2 WHERE id = ?3;",
+		strings.Join(t.Tags, " "), strings.Join(t.StickyTags, " "),
+		string(t.Id))
+}
+
+func (s *sqlStorage) DeleteThread(tid threadId) error {
+	return s.exec("DELETE FROM threads WHERE id = ?1;", string(tid))
+}
+
+func (s *sqlStorage) BlockMedia(i *media) error {
+	return s.exec("UPDATE media SET ban_reason = ?1 WHERE hash = ?2;",
+		i.Blocked.Name, i.Hash)
+}
+
+func (s *sqlStorage) UpdateMediaSHA256(i *media) error {
+	return s.exec("UPDATE media SET sha256 = ?1 WHERE hash = ?2;",
+		i.SHA256, i.Hash)
+}
+
+func (s *sqlStorage) UpdateMediaPHash(i *media) error {
+	return s.exec("UPDATE media SET phash = ?1 WHERE hash = ?2;",
+		i.PHash, i.Hash)
+}
+
+func (s *sqlStorage) UpdateMediaThumb(i *media) error {
+	return s.exec("UPDATE media SET thumb = ?1 WHERE hash = ?2;",
+		i.Thumb, i.Hash)
+}
+
+// Bans are identified in the database by address and start time, since
+// they may still be waiting in persistBan without a row id. If so, the
+// pending insert will pick up the modified end time.
+func (s *sqlStorage) UpdateBanEnd(b *userBan) error {
+	return s.exec("UPDATE bans SET end_time = ?1 "+
+		"WHERE user_addr = ?2 AND start_time = ?3;",
+		b.End.Unix(), b.Addr, b.Start.Unix())
+}
+
+func (s *sqlStorage) InsertBanRevocation(b *userBan) error {
+	r := b.Revocation
+	return s.exec("INSERT INTO ban_revocations "+
+		"(user_addr, start_time, staff, reason, time) "+
+		"VALUES (?1, ?2, ?3, ?4, ?5);",
+		b.Addr, b.Start.Unix(), r.Staff, r.Reason, r.Time.Unix())
+}
+
+func (s *sqlStorage) InsertBanAppeal(b *userBan) error {
+	a := b.Appeal
+	return s.exec("INSERT INTO ban_appeals "+
+		"(user_addr, start_time, appeal, time, status, staff, response, "+
+		"decision_time) VALUES (?1, ?2, ?3, ?4, ?5, '', '', 0);",
+		b.Addr, b.Start.Unix(), a.Text, a.Time.Unix(), a.Status)
+}
+
+func (s *sqlStorage) UpdateBanAppeal(b *userBan) error {
+	a := b.Appeal
+	return s.exec("UPDATE ban_appeals SET status = ?1, staff = ?2, "+
+		"response = ?3, decision_time = ?4 "+
+		"WHERE user_addr = ?5 AND start_time = ?6;",
+		a.Status, a.Staff, a.Response, a.Decided.Unix(),
+		b.Addr, b.Start.Unix())
+}
+
+func (s *sqlStorage) InsertTagRule(r tagRule) error {
+	return s.exec("INSERT INTO tag_rules (kind, tag, target) "+
+		"VALUES (?1, ?2, ?3);", r.Kind, r.Tag, r.Target)
+}
+
+func (s *sqlStorage) DeleteTagRule(r tagRule) error {
+	return s.exec("DELETE FROM tag_rules "+
+		"WHERE kind = ?1 AND tag = ?2 AND target = ?3;",
+		r.Kind, r.Tag, r.Target)
+}
+
+func (s *sqlStorage) ReadThreads(newThread func() *thread,
+	each func(*thread)) error {
+
+	query := "SELECT id, random_mark, updated, tags, " +
+		"sticky_tags, locked, hidden FROM threads ORDER BY updated, id;"
+
+	return s.query(query, func(rows *sql.Rows) error {
+		t := newThread()
+		var updated int64
+		var tid, tags, stickyTags string
+		e := rows.Scan(&tid, &t.RandomMark, &updated,
+			&tags, &stickyTags, &t.Locked, &t.Hidden)
+
+		if e != nil {
+			return e
+		}
+
+		t.Id = threadId(tid)
+		t.Updated = time.Unix(updated, 0)
+		t.Tags = strings.Fields(tags)
+		t.StickyTags = strings.Fields(stickyTags)
+		each(t)
+		return nil
+	})
+}
+
+func (s *sqlStorage) ReadPosts(each func(p *post, mediaHash *string)) error {
+	query := "SELECT comment, user_addr, media, media_name, global_id, " +
+		"local_id, reply_to, time, parent_thread, hidden, authority, no_bump, " +
+		"delete_secret FROM posts ORDER BY global_id;"
+
+	return s.query(query, func(rows *sql.Rows) error {
+		p := &post{}
+		var tid string
+		var imgHash *string
+		var postTime *uint64
+		e := rows.Scan(&p.Comment, &p.UserAddr, &imgHash, &p.MediaName,
+			&p.GlobalId, &p.LocalId, &p.ReplyTo, &postTime,
+			&tid, &p.Hidden, &p.RoleName, &p.NoBump, &p.DeleteSecret)
+
+		if e != nil {
+			return e
+		}
+
+		p.ParentThread = threadId(tid)
+		p.Time = time.Unix(int64(*postTime), 0)
+		each(p, imgHash)
+		return nil
+	})
+}
+
+func (s *sqlStorage) ReadMedia(each func(i *media, banReason string)) error {
+	query := ("SELECT hash, thumb, type, info, size, ban_reason, sha256, " +
+		"phash, content_type FROM media;")
+
+	return s.query(query, func(rows *sql.Rows) error {
+		i := new(media)
+		var reasonName string
+		e := rows.Scan(&i.Hash, &i.Thumb, &i.MediaType,
+			&i.InfoString, &i.Size, &reasonName, &i.SHA256, &i.PHash,
+			&i.ContentType)
+		if e != nil {
+			return e
+		}
+
+		each(i, reasonName)
+		return nil
+	})
+}
+
+func (s *sqlStorage) ReadBans(each func(*userBan)) error {
+	query := ("SELECT user_addr, reason, description, start_time, end_time " +
+		"FROM bans ORDER BY id;")
+
+	return s.query(query, func(rows *sql.Rows) error {
+		ban := &userBan{}
+		var start, end int64
+		e := rows.Scan(&ban.Addr, &ban.Reason.Name, &ban.Reason.Description,
+			&start, &end)
+
+		if e != nil {
+			return e
+		}
+
+		ban.Start = time.Unix(start, 0)
+		ban.End = time.Unix(end, 0)
+		ban.Duration = ban.End.Sub(ban.Start)
+		each(ban)
+		return nil
+	})
+}
+
+func (s *sqlStorage) ReadBanRevocations(
+	each func(addr string, start int64, r *banRevocation)) error {
+
+	query := ("SELECT user_addr, start_time, staff, reason, time " +
+		"FROM ban_revocations ORDER BY id;")
+
+	return s.query(query, func(rows *sql.Rows) error {
+		var addr string
+		var start, revoked int64
+		r := &banRevocation{}
+		e := rows.Scan(&addr, &start, &r.Staff, &r.Reason, &revoked)
+		if e != nil {
+			return e
+		}
+
+		r.Time = time.Unix(revoked, 0)
+		each(addr, start, r)
+		return nil
+	})
+}
+
+func (s *sqlStorage) ReadBanAppeals(
+	each func(addr string, start int64, a *banAppeal)) error {
+
+	query := ("SELECT user_addr, start_time, appeal, time, status, staff, " +
+		"response, decision_time FROM ban_appeals ORDER BY id;")
+
+	return s.query(query, func(rows *sql.Rows) error {
+		var addr string
+		var start, appealed, decided int64
+		a := &banAppeal{}
+		e := rows.Scan(&addr, &start, &a.Text, &appealed, &a.Status,
+			&a.Staff, &a.Response, &decided)
+		if e != nil {
+			return e
+		}
+
+		a.Time = time.Unix(appealed, 0)
+		a.Decided = time.Unix(decided, 0)
+		each(addr, start, a)
+		return nil
+	})
+}
+
+func (s *sqlStorage) ReadReports(each func(reportEntry)) error {
+	query := "SELECT parent_thread, local_id, queue, user_addr, time " +
+		"FROM reports ORDER BY id;"
+
+	return s.query(query, func(rows *sql.Rows) error {
+		var r reportEntry
+		var tid string
+		var reportTime int64
+		e := rows.Scan(&tid, &r.Lid, &r.Queue, &r.SubmitterAddr, &reportTime)
+		if e != nil {
+			return e
+		}
+
+		r.Thread = threadId(tid)
+		r.Time = time.Unix(reportTime, 0)
+		each(r)
+		return nil
+	})
+}
+
+func (s *sqlStorage) ReadTagRules(each func(tagRule)) error {
+	query := "SELECT kind, tag, target FROM tag_rules ORDER BY id;"
+
+	return s.query(query, func(rows *sql.Rows) error {
+		var r tagRule
+		if e := rows.Scan(&r.Kind, &r.Tag, &r.Target); e != nil {
+			return e
+		}
+
+		each(r)
+		return nil
+	})
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	_ "github.com/lib/pq"
+	"regexp"
+)
+
+var placeholderPattern = regexp.MustCompile(`\?(\d+)`)
+
+var postgresDialect = sqlDialect{
+	Driver: "postgres",
+	Rebind: func(query string) string {
+		return placeholderPattern.ReplaceAllString(query, "$$$1")
+	},
+	Schema: func(m migration) []string { return m.Postgres },
+}
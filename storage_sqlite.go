@@ -0,0 +1,17 @@
+package main
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteDialect = sqlDialect{
+	Driver: "sqlite3",
+	Init:   []string{"PRAGMA foreign_keys = ON;"},
+	Rebind: func(query string) string { return query },
+	Schema: func(m migration) []string { return m.SQLite },
+	Backup: func(db *sql.DB, dest string) error {
+		_, e := db.Exec("VACUUM INTO ?1;", dest)
+		return e
+	},
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPostgresRebind(t *testing.T) {
+	cases := []struct {
+		query, want string
+	}{
+		{"SELECT id FROM threads;", "SELECT id FROM threads;"},
+		{"DELETE FROM threads WHERE id = ?1;",
+			"DELETE FROM threads WHERE id = $1;"},
+		{"UPDATE posts SET hidden = ?1 WHERE parent_thread = ?2 AND local_id = ?3;",
+			"UPDATE posts SET hidden = $1 WHERE parent_thread = $2 AND local_id = $3;"},
+		{"VALUES (?9, ?10, ?11, ?12);", "VALUES ($9, $10, $11, $12);"},
+		{"WHERE a = ?1 OR b = ?1;", "WHERE a = $1 OR b = $1;"},
+		{"WHERE a = ?", "WHERE a = ?"},
+	}
+
+	for _, c := range cases {
+		if got := postgresDialect.Rebind(c.query); got != c.want {
+			t.Errorf("Rebind(%q) = %q, want %q", c.query, got, c.want)
+		}
+		if got := sqliteDialect.Rebind(c.query); got != c.query {
+			t.Errorf("SQLite Rebind(%q) = %q, want it unchanged", c.query, got)
+		}
+	}
+}
+
+func TestMigrationsCoverDialects(t *testing.T) {
+	for i, m := range migrations {
+		if m.Description == "" {
+			t.Errorf("migration %d has no description", i+1)
+		}
+		if len(sqliteDialect.Schema(m)) == 0 || len(postgresDialect.Schema(m)) == 0 {
+			t.Errorf("migration %d (%s) is missing statements for a dialect",
+				i+1, m.Description)
+		}
+	}
+}
+
+func testSQLiteStorage(t *testing.T) *sqlStorage {
+	s, e := newSQLStorage(sqliteDialect, filepath.Join(t.TempDir(), "test.db"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLiteBatchSkipsFailedRows(t *testing.T) {
+	s := testSQLiteStorage(t)
+
+	now := time.Unix(1000, 0)
+	threads := []*thread{
+		{Id: "a", Updated: now},
+		{Id: "a", Updated: now},
+		{Id: "b", Updated: now},
+	}
+
+	e := s.InsertThreads(threads)
+	be, ok := e.(*batchError)
+	if !ok {
+		t.Fatalf("InsertThreads with a duplicate returned %v, want *batchError", e)
+	}
+	if len(be.Failed) != 1 || be.Failed[1] == nil {
+		t.Errorf("failed rows = %v, want only row 1", be.Failed)
+	}
+
+	got := []string{}
+	e = s.ReadThreads(func() *thread { return &thread{} }, func(t *thread) {
+		got = append(got, string(t.Id))
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stored threads %v, want %v", got, want)
+	}
+}
+
+func TestSQLiteReadOrder(t *testing.T) {
+	s := testSQLiteStorage(t)
+
+	threads := []*thread{
+		{Id: "new", Updated: time.Unix(3000, 0)},
+		{Id: "old", Updated: time.Unix(1000, 0)},
+		{Id: "mid", Updated: time.Unix(2000, 0)},
+	}
+	if e := s.InsertThreads(threads); e != nil {
+		t.Fatal(e)
+	}
+
+	posts := []*post{}
+	for _, gid := range []postGid{3, 1, 2} {
+		posts = append(posts, &post{GlobalId: gid, ParentThread: "old",
+			Time: time.Unix(1000, 0)})
+	}
+	if e := s.InsertPosts(posts); e != nil {
+		t.Fatal(e)
+	}
+
+	gotThreads := []string{}
+	e := s.ReadThreads(func() *thread { return &thread{} }, func(t *thread) {
+		gotThreads = append(gotThreads, string(t.Id))
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if want := []string{"old", "mid", "new"}; !reflect.DeepEqual(gotThreads, want) {
+		t.Errorf("threads read as %v, want %v", gotThreads, want)
+	}
+
+	gotPosts := []postGid{}
+	e = s.ReadPosts(func(p *post, mediaHash *string) {
+		gotPosts = append(gotPosts, p.GlobalId)
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if want := []postGid{1, 2, 3}; !reflect.DeepEqual(gotPosts, want) {
+		t.Errorf("posts read as %v, want %v", gotPosts, want)
+	}
+}
+
+func TestSQLiteAtomic(t *testing.T) {
+	s := testSQLiteStorage(t)
+	th := &thread{Id: "a", Updated: time.Unix(1000, 0)}
+
+	count := func() int {
+		n := 0
+		s.ReadThreads(func() *thread { return &thread{} }, func(*thread) { n++ })
+		s.ReadTagRules(func(tagRule) { n++ })
+		return n
+	}
+
+	// A rejected row fails the whole group, not just its own batch.
+	e := s.Atomic(func(st storage) error {
+		if e := st.InsertThreads([]*thread{th}); e != nil {
+			return e
+		}
+		if e := st.InsertTagRule(tagRule{"alias", "pic", "picture"}); e != nil {
+			return e
+		}
+		return st.InsertThreads([]*thread{th})
+	})
+	if e == nil {
+		t.Fatal("Atomic with a duplicate row succeeded")
+	}
+	if n := count(); n != 0 {
+		t.Errorf("%d records kept after a failed Atomic, want 0", n)
+	}
+
+	e = s.Atomic(func(st storage) error {
+		if e := st.InsertThreads([]*thread{th}); e != nil {
+			return e
+		}
+		return st.InsertTagRule(tagRule{"alias", "pic", "picture"})
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("%d records after a successful Atomic, want 2", n)
+	}
+}
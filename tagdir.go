@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Period over which posts per day are averaged in the tag directory.
+const tagActivityWindow = 7 * 24 * time.Hour
+
+// Summary of a non-system tag for the tag directory.
+type tagStats struct {
+	Name        string    `json:"name"`
+	Threads     uint      `json:"threads"`
+	Sticky      uint      `json:"sticky"`
+	Updated     time.Time `json:"updated"`
+	PostsPerDay float64   `json:"posts_per_day"`
+}
+
+// Orders for the directory, by name of the sort parameter.
+var tagStatsOrders = map[string]func(a, b tagStats) bool{
+	"name":     func(a, b tagStats) bool { return a.Name < b.Name },
+	"threads":  func(a, b tagStats) bool { return a.Threads > b.Threads },
+	"updated":  func(a, b tagStats) bool { return a.Updated.After(b.Updated) },
+	"activity": func(a, b tagStats) bool { return a.PostsPerDay > b.PostsPerDay },
+}
+
+// Directory of tags, rebuilt from the hive when threads attach or leave
+// tags, or when it is older than the configured lifetime.
+type tagDirectoryCache struct {
+	Stats      []tagStats
+	Built      time.Time
+	Generation uint
+	mtx        sync.Mutex
+}
+
+var tagDirectory tagDirectoryCache
+
+func (tc *tagDirectoryCache) SetStale() {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+
+	tc.Generation++
+	tc.Stats = nil
+}
+
+// Return the current directory. The hive is queried without holding the
+// mutex, since it marks the directory stale from inside the hive.
+func (tc *tagDirectoryCache) Get() []tagStats {
+	tc.mtx.Lock()
+	stats, generation := tc.Stats, tc.Generation
+	expired := time.Since(tc.Built) > settings.Catalog.TagDirectoryLifetime.Duration
+	tc.mtx.Unlock()
+
+	if stats != nil && !expired {
+		return stats
+	}
+
+	hiveReq(func(h *hive) {
+		stats = h.tags.Stats()
+	})
+
+	tc.mtx.Lock()
+	if tc.Generation == generation {
+		tc.Stats, tc.Built = stats, time.Now()
+	}
+	tc.mtx.Unlock()
+
+	return stats
+}
+
+// Collect directory entries for every tag users can see.
+func (pile tagMap) Stats() []tagStats {
+	out := []tagStats{}
+	since := time.Now().Add(-tagActivityWindow)
+
+	for name, tag := range pile {
+		if strings.HasPrefix(name, "!!_") || strings.HasPrefix(name, "!?_") {
+			continue
+		}
+
+		ts := tagStats{Name: name, Threads: tag.Normal.Count,
+			Sticky: tag.Sticky.Count}
+
+		var recent int
+		for _, tl := range []*threadList{tag.Normal, tag.Sticky} {
+			for e := tl.Threads.Front(); e != nil; e = e.Next() {
+				t := e.Value.(*thread)
+				if t.Updated.After(ts.Updated) {
+					ts.Updated = t.Updated
+				}
+
+				for i := len(t.Posts) - 1; i >= 0; i-- {
+					if t.Posts[i].Time.Before(since) {
+						break
+					}
+					recent++
+				}
+			}
+		}
+
+		if ts.Threads+ts.Sticky == 0 {
+			continue
+		}
+
+		ts.PostsPerDay = float64(recent) / tagActivityWindow.Hours() * 24
+		out = append(out, ts)
+	}
+
+	return out
+}
+
+// Filter and order the directory according to the request's prefix and
+// sort parameters. Returns false for an unknown sort order.
+func selectTagStats(r *http.Request) (string, string, []tagStats, bool) {
+	prefix := strings.ToLower(r.FormValue("prefix"))
+	order := r.FormValue("sort")
+	if order == "" {
+		order = "threads"
+	}
+
+	less, ok := tagStatsOrders[order]
+	if !ok {
+		return prefix, order, nil, false
+	}
+
+	out := []tagStats{}
+	for _, ts := range tagDirectory.Get() {
+		if strings.HasPrefix(ts.Name, prefix) {
+			out = append(out, ts)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if less(out[i], out[j]) != less(out[j], out[i]) {
+			return less(out[i], out[j])
+		}
+		return out[i].Name < out[j].Name
+	})
+
+	return prefix, order, out, true
+}
+
+func showTagDirectory(w http.ResponseWriter, r *http.Request) {
+	prefix, order, stats, ok := selectTagStats(r)
+	if !ok {
+		msg(w, 404, "404")
+		return
+	}
+
+	data := struct {
+		Prefix   string
+		Sort     string
+		Tags     []tagStats
+		Settings *tolxankaConfigToml
+	}{prefix, order, stats, settings}
+
+	w.Header().Set("Content-Type", "application/xhtml+xml; charset=UTF-8")
+	if e := templates.ExecuteTemplate(w, "tag_directory", data); e != nil {
+		log.Println(e)
+	}
+}
+
+// /api/v1/tags
+func showAPITags(w http.ResponseWriter, r *http.Request) {
+	prefix, order, stats, ok := selectTagStats(r)
+	if !ok {
+		apiError(w, http.StatusNotFound, "404")
+		return
+	}
+
+	writeJSON(w, marshalAPI(struct {
+		Prefix string     `json:"prefix"`
+		Sort   string     `json:"sort"`
+		Tags   []tagStats `json:"tags"`
+	}{prefix, order, stats}))
+}
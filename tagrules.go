@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A staff-managed rule for rewriting thread tags. An alias replaces Tag with
+// Target wherever it is used; an implication adds Target to every thread
+// tagged with Tag.
+type tagRule struct {
+	Kind   string
+	Tag    string
+	Target string
+}
+
+// Rules in effect, kept by the hive. Implications are keyed and stored by
+// canonical tag names.
+type tagRules struct {
+	Aliases      map[string]string
+	Implications map[string][]string
+}
+
+func newTagRules() tagRules {
+	return tagRules{
+		Aliases:      map[string]string{},
+		Implications: map[string][]string{},
+	}
+}
+
+// Resolve a tag through any aliases.
+func (tr tagRules) Canonical(tag string) string {
+	for i := 0; i <= len(tr.Aliases); i++ {
+		target, ok := tr.Aliases[tag]
+		if !ok {
+			break
+		}
+		tag = target
+	}
+	return tag
+}
+
+// Apply the rules to a list of tags: aliases are resolved and implied tags
+// follow the tags implying them, without duplicates.
+func (tr tagRules) Expand(tags []string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+
+	var add func(tag string)
+	add = func(tag string) {
+		tag = tr.Canonical(tag)
+		if seen[tag] {
+			return
+		}
+
+		seen[tag] = true
+		out = append(out, tag)
+		for _, implied := range tr.Implications[tag] {
+			add(implied)
+		}
+	}
+
+	for _, tag := range tags {
+		add(tag)
+	}
+	return out
+}
+
+// Check a new rule against the existing ones. Aliases may not form cycles,
+// and a tag with implications can't become an alias, as its implications
+// would no longer apply.
+func (tr tagRules) Check(r tagRule) error {
+	for _, tag := range []string{r.Tag, r.Target} {
+		if tag == "" || strings.ContainsAny(tag, " \t\n()") {
+			return errors.New("invalid_fields")
+		}
+
+		if strings.HasPrefix(tag, "!!_") || strings.HasPrefix(tag, "!?_") {
+			return errors.New("prohibited_tags")
+		}
+
+		if len(tag) > settings.Limit.TagLength {
+			return errors.New("tag_too_long")
+		}
+	}
+
+	switch r.Kind {
+	case "alias":
+		if _, ok := tr.Aliases[r.Tag]; ok {
+			return errors.New("tag_rule_exists")
+		}
+		if len(tr.Implications[r.Tag]) > 0 || tr.Canonical(r.Target) == r.Tag {
+			return errors.New("tag_rule_conflict")
+		}
+	case "implication":
+		tag, target := tr.Canonical(r.Tag), tr.Canonical(r.Target)
+		if tag == target {
+			return errors.New("tag_rule_conflict")
+		}
+		for _, implied := range tr.Implications[tag] {
+			if implied == target {
+				return errors.New("tag_rule_exists")
+			}
+		}
+	default:
+		return errors.New("invalid_fields")
+	}
+
+	return nil
+}
+
+// Add a checked rule, returning it as stored.
+func (tr tagRules) Add(r tagRule) tagRule {
+	switch r.Kind {
+	case "alias":
+		tr.Aliases[r.Tag] = r.Target
+	case "implication":
+		r.Tag, r.Target = tr.Canonical(r.Tag), tr.Canonical(r.Target)
+		tr.Implications[r.Tag] = append(tr.Implications[r.Tag], r.Target)
+	}
+	return r
+}
+
+// Remove a rule, returning whether it existed.
+func (tr tagRules) Remove(r tagRule) bool {
+	switch r.Kind {
+	case "alias":
+		if target, ok := tr.Aliases[r.Tag]; ok && target == r.Target {
+			delete(tr.Aliases, r.Tag)
+			return true
+		}
+	case "implication":
+		implied := tr.Implications[r.Tag]
+		for i, target := range implied {
+			if target == r.Target {
+				tr.Implications[r.Tag] = append(implied[:i:i], implied[i+1:]...)
+				if len(tr.Implications[r.Tag]) == 0 {
+					delete(tr.Implications, r.Tag)
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Every rule, sorted by kind and tag.
+func (tr tagRules) List() []tagRule {
+	out := []tagRule{}
+	for tag, target := range tr.Aliases {
+		out = append(out, tagRule{"alias", tag, target})
+	}
+	for tag, implied := range tr.Implications {
+		for _, target := range implied {
+			out = append(out, tagRule{"implication", tag, target})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return out[i].Kind < out[j].Kind
+		}
+		if out[i].Tag != out[j].Tag {
+			return out[i].Tag < out[j].Tag
+		}
+		return out[i].Target < out[j].Target
+	})
+	return out
+}
+
+func (h *hive) recoverTagRules() {
+	e := store.ReadTagRules(func(r tagRule) {
+		h.rules.Add(r)
+	})
+
+	if e != nil {
+		log.Panic(e)
+	}
+}
+
+func (h *hive) AddTagRule(r tagRule) error {
+	if e := h.rules.Check(r); e != nil {
+		return e
+	}
+
+	if e := store.InsertTagRule(h.rules.Add(r)); e != nil {
+		log.Panic(e)
+	}
+
+	h.reattachAllTags()
+	return nil
+}
+
+// Removing an implication drops its target from threads where nothing else
+// implies it. Tags don't record where they came from, so a thread tagged
+// with both by its poster loses the target too. Removing an alias can't
+// restore the tags it rewrote, so it only affects later threads.
+func (h *hive) RemoveTagRule(r tagRule) error {
+	if !h.rules.Remove(r) {
+		return errors.New("tag_rule_not_exist")
+	}
+
+	if e := store.DeleteTagRule(r); e != nil {
+		log.Panic(e)
+	}
+
+	if r.Kind == "implication" {
+		h.stripImplied(r)
+	}
+
+	h.reattachAllTags()
+	return nil
+}
+
+// Remove an implication's target from the threads it was added to.
+func (h *hive) stripImplied(r tagRule) {
+	without := func(tags []string, name string) []string {
+		out := []string{}
+		for _, tag := range tags {
+			if tag != name {
+				out = append(out, tag)
+			}
+		}
+		return out
+	}
+
+	for _, t := range h.Threads {
+		all := append(append([]string{}, t.Tags...), t.StickyTags...)
+		if !inList(all, r.Tag) || !inList(all, r.Target) {
+			continue
+		}
+
+		if inList(h.rules.Expand(without(all, r.Target)), r.Target) {
+			continue
+		}
+
+		if tag, ok := h.tags[r.Target]; ok {
+			tag.Normal.RemoveThread(t)
+			tag.Sticky.RemoveThread(t)
+		}
+
+		t.Tags = without(t.Tags, r.Target)
+		t.StickyTags = without(t.StickyTags, r.Target)
+		if e := store.UpdateThreadTags(t); e != nil {
+			log.Panic(e)
+		}
+
+		t.UpdateThreadSummary()
+		pageCache.SetStale(string(t.Id), t.Hidden)
+	}
+}
+
+// Bring every thread's tags in line with the current rules, moving threads
+// between tag lists without disturbing their bump order.
+func (h *hive) reattachAllTags() {
+	for _, t := range h.Threads {
+		sticky := h.rules.Expand(t.StickyTags)
+		isSticky := map[string]bool{}
+		for _, tag := range sticky {
+			isSticky[tag] = true
+		}
+
+		normal := []string{}
+		all := append(append([]string{}, t.Tags...), t.StickyTags...)
+		for _, tag := range h.rules.Expand(all) {
+			if !isSticky[tag] {
+				normal = append(normal, tag)
+			}
+		}
+
+		if strings.Join(normal, " ") == strings.Join(t.Tags, " ") &&
+			strings.Join(sticky, " ") == strings.Join(t.StickyTags, " ") {
+			continue
+		}
+
+		for _, name := range t.Tags {
+			if tag, ok := h.tags[name]; ok {
+				tag.Normal.RemoveThread(t)
+			}
+		}
+		for _, name := range t.StickyTags {
+			if tag, ok := h.tags[name]; ok {
+				tag.Sticky.RemoveThread(t)
+			}
+		}
+
+		t.Tags, t.StickyTags = normal, sticky
+		for _, name := range t.Tags {
+			h.tagNamed(name).Normal.InsertThread(t)
+		}
+		for _, name := range t.StickyTags {
+			h.tagNamed(name).Sticky.AddThread(t)
+		}
+
+		if e := store.UpdateThreadTags(t); e != nil {
+			log.Panic(e)
+		}
+
+		t.UpdateThreadSummary()
+		pageCache.SetStale(string(t.Id), t.Hidden)
+	}
+
+	h.tags.dropEmpty()
+	h.tags.genAutocompleteXml()
+	tagDirectory.SetStale()
+}
+
+func showTagRules(w http.ResponseWriter, r *http.Request) {
+	if !getStaffRole(r).ManageTags {
+		return
+	}
+
+	var rules []tagRule
+	hiveReq(func(h *hive) {
+		rules = h.rules.List()
+	})
+
+	if e := templates.ExecuteTemplate(w, "tag_rules", rules); e != nil {
+		log.Println(e)
+	}
+}
+
+func postTagRule(w http.ResponseWriter, r *http.Request) {
+	if !getStaffRole(r).ManageTags {
+		return
+	}
+
+	r.ParseForm()
+	rule := tagRule{
+		Kind:   r.Form.Get("kind"),
+		Tag:    strings.ToLower(strings.TrimSpace(r.Form.Get("tag"))),
+		Target: strings.ToLower(strings.TrimSpace(r.Form.Get("target"))),
+	}
+
+	remove := r.Form.Get("action") == "remove"
+	action := "adding"
+	if remove {
+		action = "removing"
+	}
+
+	log.Printf("%s %s tag %s %s -> %s", getStaffName(r), action,
+		rule.Kind, rule.Tag, rule.Target)
+
+	var e error
+	hiveReq(func(h *hive) {
+		if remove {
+			e = h.RemoveTagRule(rule)
+		} else {
+			e = h.AddTagRule(rule)
+		}
+	})
+
+	if e != nil {
+		msg(w, 200, e.Error())
+		return
+	}
+
+	passthrough(w, "tag_rules_updated", "/admin_tag_rules")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testTagRules(rules ...tagRule) tagRules {
+	tr := newTagRules()
+	for _, r := range rules {
+		tr.Add(r)
+	}
+	return tr
+}
+
+func TestTagRulesCanonical(t *testing.T) {
+	tr := testTagRules(
+		tagRule{"alias", "pic", "picture"},
+		tagRule{"alias", "picture", "image"},
+		// Rules read back from the database aren't checked, so a cycle
+		// must not hang.
+		tagRule{"alias", "x", "y"},
+		tagRule{"alias", "y", "x"},
+	)
+
+	cases := []struct {
+		tag, want string
+	}{
+		{"pic", "image"},
+		{"picture", "image"},
+		{"image", "image"},
+		{"other", "other"},
+	}
+
+	for _, c := range cases {
+		if got := tr.Canonical(c.tag); got != c.want {
+			t.Errorf("Canonical(%q) = %q, want %q", c.tag, got, c.want)
+		}
+	}
+
+	if got := tr.Canonical("x"); got != "x" && got != "y" {
+		t.Errorf("Canonical of an alias cycle = %q, want x or y", got)
+	}
+}
+
+func TestTagRulesExpand(t *testing.T) {
+	tr := testTagRules(
+		tagRule{"alias", "kitty", "cat"},
+		tagRule{"implication", "cat", "animal"},
+		tagRule{"implication", "animal", "creature"},
+		tagRule{"implication", "yin", "yang"},
+		tagRule{"implication", "yang", "yin"},
+	)
+
+	cases := []struct {
+		tags, want []string
+	}{
+		{[]string{}, []string{}},
+		{[]string{"dog"}, []string{"dog"}},
+		{[]string{"kitty"}, []string{"cat", "animal", "creature"}},
+		{[]string{"cat", "kitty", "animal"},
+			[]string{"cat", "animal", "creature"}},
+		{[]string{"creature", "cat"}, []string{"creature", "cat", "animal"}},
+		{[]string{"yin"}, []string{"yin", "yang"}},
+		{[]string{"yang", "dog"}, []string{"yang", "yin", "dog"}},
+	}
+
+	for _, c := range cases {
+		if got := tr.Expand(c.tags); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Expand(%q) = %q, want %q", c.tags, got, c.want)
+		}
+	}
+}
+
+func TestTagRulesCheck(t *testing.T) {
+	settings = &tolxankaConfigToml{}
+	settings.Limit.TagLength = 16
+
+	tr := testTagRules(
+		tagRule{"alias", "pic", "picture"},
+		tagRule{"alias", "picture", "image"},
+		tagRule{"implication", "cat", "animal"},
+	)
+
+	cases := []struct {
+		rule tagRule
+		err  string
+	}{
+		{tagRule{"alias", "photo", "image"}, ""},
+		{tagRule{"alias", "pic", "photo"}, "tag_rule_exists"},
+		{tagRule{"alias", "image", "pic"}, "tag_rule_conflict"},
+		{tagRule{"alias", "image", "picture"}, "tag_rule_conflict"},
+		{tagRule{"alias", "cat", "kitty"}, "tag_rule_conflict"},
+		{tagRule{"implication", "kitten", "cat"}, ""},
+		{tagRule{"implication", "animal", "cat"}, ""},
+		{tagRule{"implication", "cat", "animal"}, "tag_rule_exists"},
+		{tagRule{"implication", "pic", "image"}, "tag_rule_conflict"},
+		{tagRule{"implication", "pic", "picture"}, "tag_rule_conflict"},
+		{tagRule{"rename", "a", "b"}, "invalid_fields"},
+		{tagRule{"alias", "", "b"}, "invalid_fields"},
+		{tagRule{"alias", "a b", "c"}, "invalid_fields"},
+		{tagRule{"alias", "a", "(b"}, "invalid_fields"},
+		{tagRule{"alias", "!!_all", "b"}, "prohibited_tags"},
+		{tagRule{"implication", "a", "!?_admin"}, "prohibited_tags"},
+		{tagRule{"alias", strings.Repeat("a", 17), "b"}, "tag_too_long"},
+	}
+
+	for _, c := range cases {
+		var got string
+		if e := tr.Check(c.rule); e != nil {
+			got = e.Error()
+		}
+		if got != c.err {
+			t.Errorf("Check(%v) = %q, want %q", c.rule, got, c.err)
+		}
+	}
+}
+
+func TestTagRulesAddRemove(t *testing.T) {
+	tr := testTagRules(tagRule{"alias", "kitty", "cat"})
+
+	stored := tr.Add(tagRule{"implication", "kitty", "animal"})
+	if want := (tagRule{"implication", "cat", "animal"}); stored != want {
+		t.Errorf("Add stored %v, want %v", stored, want)
+	}
+	tr.Add(tagRule{"implication", "cat", "pet"})
+
+	want := []tagRule{
+		{"alias", "kitty", "cat"},
+		{"implication", "cat", "animal"},
+		{"implication", "cat", "pet"},
+	}
+	if got := tr.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+
+	cases := []struct {
+		rule    tagRule
+		removed bool
+	}{
+		{tagRule{"alias", "kitty", "dog"}, false},
+		{tagRule{"implication", "kitty", "animal"}, false},
+		{tagRule{"implication", "cat", "animal"}, true},
+		{tagRule{"implication", "cat", "animal"}, false},
+		{tagRule{"implication", "cat", "pet"}, true},
+		{tagRule{"alias", "kitty", "cat"}, true},
+	}
+
+	for _, c := range cases {
+		if got := tr.Remove(c.rule); got != c.removed {
+			t.Errorf("Remove(%v) = %v, want %v", c.rule, got, c.removed)
+		}
+	}
+
+	if len(tr.Aliases) != 0 || len(tr.Implications) != 0 {
+		t.Errorf("rules left after removing all: %v", tr.List())
+	}
+}
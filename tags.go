@@ -39,9 +39,14 @@ type parsedQuery struct {
 	Merge       []string
 	Filter      []string
 	Exclude     []string
+	Comment     []string // Words which must appear in a post of the thread.
+	Expression  string   // Set when the query does not fit Merge/Filter/Exclude.
+	Sort        string   // Name of the result order.
+	Expr        tagExpr
 	Page        int
 	View        string
 	QueryString string
+	BaseURL     string
 	Admin       bool
 
 	WriteOut http.ResponseWriter
@@ -67,24 +72,60 @@ func (pile tagMap) genAutocompleteXml() {
 	tagSearch.Data = buf.Bytes()
 }
 
-// Logically filters all threads to include only those which include all
-// of the named tags, and returns the specified range.
+// Forget user tags no thread carries any more, so they leave autocompletion.
+func (pile tagMap) dropEmpty() {
+	for name, tag := range pile {
+		if strings.HasPrefix(name, "!?_") || strings.HasPrefix(name, "!!_") {
+			continue
+		}
+
+		if tag.Normal.Count == 0 && tag.Sticky.Count == 0 {
+			delete(pile, name)
+		}
+	}
+}
+
+// Returns the specified range of threads matching the query expression,
+// newest first. If the query has comment terms, only threads in the
+// comments set are returned.
 func (pile tagMap) Query(offset, perQuery int,
-	search parsedQuery) ([]*thread, int) {
+	search parsedQuery, comments map[threadId]bool) ([]*thread, int) {
 
 	var start, middle, end int
 
-	// If the filter contains missing tags, this part of the query can
-	// logically never return any results; therefore, empty the filtered tags
-	// list. The only possible results will now come from tag merging.
-	filterTags := pile.Lookup(search.Filter)
-	if len(filterTags) < len(search.Filter) {
-		filterTags = []*tag{}
+	if search.Expr == nil {
+		return []*thread{}, 0
+	}
+
+	// An expression without positive tags, such as a comment search alone,
+	// searches every thread.
+	candidates, all := search.Expr.Candidates(pile)
+	if all {
+		candidates = pile.Lookup([]string{"!!_all"})
+	}
+
+	found := make(map[*thread]bool)
+	nextCandidate := mergeGenerator(candidates)
+	nextThread := func() *thread {
+		for t := nextCandidate(); t != nil; t = nextCandidate() {
+			if found[t] {
+				continue
+			}
+			found[t] = true
+
+			if len(search.Comment) > 0 && !comments[t.Id] {
+				continue
+			}
+			if search.Expr.Match(pile, t) {
+				return t
+			}
+		}
+		return nil
 	}
 
-	nextThread := makeResultGenerator(filterTags,
-		pile.Lookup(search.Merge),
-		pile.Lookup(search.Exclude))
+	if less := threadOrder(search.Sort); less != nil {
+		nextThread = sortedGenerator(nextThread, less)
+	}
 
 	for ; start < offset; start++ {
 		if nextThread() == nil {
@@ -116,6 +157,75 @@ func (pile tagMap) Query(offset, perQuery int,
 	return threads, start + middle + end
 }
 
+// A way of ordering query results. Less reports whether a is listed
+// before b.
+type threadOrdering struct {
+	Name string
+	Less func(a, b *thread) bool
+}
+
+// Result orders selectable with the sort parameter. Bump order is the order
+// of the tag lists themselves and needs no sorting.
+var threadOrderings = []threadOrdering{
+	{"bump", nil},
+	{"created", func(a, b *thread) bool {
+		return a.Created.After(b.Created)
+	}},
+	{"replies", func(a, b *thread) bool {
+		return a.Count.Posts > b.Count.Posts
+	}},
+	{"media", func(a, b *thread) bool {
+		return a.Count.Media > b.Count.Media
+	}},
+	{"active", func(a, b *thread) bool {
+		return a.LastPost.After(b.LastPost)
+	}},
+}
+
+func validThreadOrder(name string) bool {
+	for _, o := range threadOrderings {
+		if o.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func threadOrder(name string) func(a, b *thread) bool {
+	for _, o := range threadOrderings {
+		if o.Name == name {
+			return o.Less
+		}
+	}
+	return nil
+}
+
+// Returns a generator function which drains next and then returns its
+// threads in the given order. Threads which compare equal keep their bump
+// order.
+func sortedGenerator(next func() *thread,
+	less func(a, b *thread) bool) func() *thread {
+
+	threads := []*thread{}
+	for t := next(); t != nil; t = next() {
+		threads = append(threads, t)
+	}
+
+	sort.SliceStable(threads, func(i, j int) bool {
+		return less(threads[i], threads[j])
+	})
+
+	return func() *thread {
+		if len(threads) == 0 {
+			return nil
+		}
+
+		t := threads[0]
+		threads = threads[1:]
+		return t
+	}
+}
+
 func (pile tagMap) GetStickyThreads(labels []string) []*thread {
 	out := []*thread{}
 
@@ -159,117 +269,6 @@ func (tl tagList) String() string {
 	return strings.Join(names, " ")
 }
 
-// Returns a generator function which, on each call, returns the next most
-// recent thread that either includes ALL of the named tags in the filtered
-// parameter, OR includes ANY of the named tags in the merged parameter.
-func makeResultGenerator(filtered, merged, excluded tagList) func() *thread {
-
-	if len(filtered) < 1 && len(merged) < 1 {
-		return func() *thread { return nil }
-	}
-
-	found := make(map[*thread]bool)
-	nextFilteredThread := filterGenerator(filtered)
-	nextMergedThread := mergeGenerator(merged)
-
-	ft := nextFilteredThread()
-	mt := nextMergedThread()
-
-	advance := func() *thread {
-		var out *thread
-		if ft == nil {
-			if ft != nil {
-				log.Printf("ft nil, returning mt %d", ft.Updated)
-			}
-			out = mt
-			mt = nextMergedThread()
-		} else if mt == nil {
-			if mt != nil {
-				log.Printf("mt nil, returning ft %d", mt.Updated)
-			}
-			out = ft
-			ft = nextFilteredThread()
-		} else {
-			if ft.Updated.After(mt.Updated) {
-				log.Printf("ft %d > mt %d, returning ft", ft.Updated, mt.Updated)
-				out = ft
-				ft = nextFilteredThread()
-			} else {
-				log.Printf("mt %d > ft %d, returning mt", mt.Updated, ft.Updated)
-				out = mt
-				mt = nextMergedThread()
-			}
-		}
-
-		return out
-	}
-
-	ignorable := func(t *thread) bool {
-		for _, actual := range t.Tags {
-			for _, forbidden := range excluded {
-				if actual == forbidden.Name {
-					return true
-				}
-			}
-		}
-		return false
-	}
-
-	return func() *thread {
-		for {
-			t := advance()
-			if t == nil {
-				return nil
-			} else if ignorable(t) {
-				found[t] = true
-				continue
-			} else if _, ok := found[t]; ok {
-				continue
-			}
-
-			found[t] = true
-			return t
-		}
-		return nil // never reached.
-	}
-}
-
-func containsAllTags(t *thread, tags tagList) bool {
-	for _, tag := range tags {
-		if _, ok := tag.Normal.Elems[t]; !ok {
-			return false
-		}
-	}
-	return true
-}
-
-// Returns a generator function which, on each call, returns the next most
-// recent thread that includes all of the named tags in the labels parameter.
-func filterGenerator(filterTags tagList) func() *thread {
-
-	if len(filterTags) == 0 {
-		return func() *thread { return nil }
-	}
-
-	sort.Sort(filterTags)
-	threadNode := filterTags[0].Normal.Threads.Front()
-
-	return func() *thread {
-		for {
-			if threadNode == nil {
-				return nil
-			}
-
-			t := threadNode.Value.(*thread)
-			threadNode = threadNode.Next()
-			if containsAllTags(t, filterTags) {
-				return t
-			}
-		}
-		return nil
-	}
-}
-
 // Returns a generator function which, on each call, returns the next most
 // recent thread from any of the named tags in the labels parameter.
 func mergeGenerator(mergeTags tagList) func() *thread {
@@ -295,8 +294,8 @@ func mergeGenerator(mergeTags tagList) func() *thread {
 			t := threadLists[i].Value.(*thread)
 			newest := threadLists[newestIndex]
 
-			if newest == nil || t.Updated.After(
-				newest.Value.(*thread).Updated) {
+			if newest == nil || t.Bumped.After(
+				newest.Value.(*thread).Bumped) {
 				newestIndex = i
 			}
 		}
@@ -379,6 +378,24 @@ func (tl *threadList) AddThread(t *thread) {
 	}
 }
 
+// Add a thread in its place by bump time rather than at the front.
+func (tl *threadList) InsertThread(t *thread) {
+	if _, ok := tl.Elems[t]; ok {
+		return
+	}
+
+	for e := tl.Threads.Front(); e != nil; e = e.Next() {
+		if !e.Value.(*thread).Bumped.After(t.Bumped) {
+			tl.Elems[t] = tl.Threads.InsertBefore(t, e)
+			tl.Count++
+			return
+		}
+	}
+
+	tl.Elems[t] = tl.Threads.PushBack(t)
+	tl.Count++
+}
+
 func (tl *threadList) RemoveThread(t *thread) {
 	e, ok := tl.Elems[t]
 	if ok {
@@ -22,6 +22,7 @@ func helperMap() template.FuncMap {
 		"join":            strings.Join,
 		"summaryTail":     summaryTail,
 		"omissionCount":   omissionCount,
+		"threadOrders":    threadOrderNames,
 	}
 }
 
@@ -139,3 +140,11 @@ func summaryTail(t *thread) []*post {
 func days(unixSeconds int) string {
 	return fmt.Sprintf("%d day(s)", unixSeconds/60/60/24)
 }
+
+func threadOrderNames() []string {
+	out := []string{}
+	for _, o := range threadOrderings {
+		out = append(out, o.Name)
+	}
+	return out
+}
@@ -5,7 +5,6 @@ import (
 	"golang.org/x/net/websocket"
 	"compress/gzip"
 	"html/template"
-	"io"
 	"log"
 	"math/rand"
 	"time"
@@ -77,6 +76,8 @@ type post struct {
 	ReportedBy       map[string]bool       // map of reports per report queue
 	AdminInfo        bool                  // Show additional info, for admin pages.
 	NoDump           bool                  // Internal post, do not dump to DB.
+	DeleteSecret     string                // Allows poster to delete post.
+	NoBump           bool                  // Reply does not bump the thread.
 }
 
 type thread struct {
@@ -90,14 +91,17 @@ type thread struct {
 	PostsByAddr   map[string][]*post // map of IPs to posts.
 	PostsBytes    []byte             // HTML of all existing posts.
 	Updated       time.Time          // Time of last post to thread.
+	Created       time.Time          // Time of first post to thread.
+	LastPost      time.Time          // Time of last post not made by a bot.
 	UpdatedString string             // User-visible and formatted Updated time.
+	Bumped        time.Time          // Time of last post that bumped thread.
 	HanGen        func() han         // Han-generating closure.
 	HanMap        map[string]han     // Map of user IPs to han characters.
 	UserIds       map[uint64]bool    // Map of taken user IDs.
 	Tags          []string           // Names of associated tags.
 	StickyTags    []string           // Names of associated sticky tags.
 	Count         contentCount       // Various coutns of media types
-	Listeners     []wsRegistration   // Websocket connections to broadcast to.
+	Listeners     []*wsRegistration  // Websocket connections to broadcast to.
 	Locked        bool               // Thread has been locked.
 	Hidden        bool               // Thread is administratively hidden.
 	NoDump        bool               // Internal thread; do not dump to DB.
@@ -113,11 +117,30 @@ type contentCount struct {
 	Audio int
 }
 
-func (t *thread) BindReply(p *post) {
+// Whether the post was made by the board itself rather than a user.
+func (p *post) IsBot() bool {
+	bot, ok := settings.Roles["Bot"]
+	return ok && p.Role == bot
+}
+
+// Whether the post moves the thread to the front of its tag lists. Opening
+// posts always do; replies don't when marked no-bump or past the bump limit.
+func (t *thread) BumpedBy(p *post) bool {
+	if p.OP {
+		return true
+	}
+
+	limit := settings.Limit.BumpLimit
+	return !p.NoBump && (limit <= 0 || int(p.LocalId) <= limit)
+}
+
+// Add a reply link to the post's target, returning whether the target
+// exists.
+func (t *thread) BindReply(p *post) bool {
 	target, ok := t.PostById[p.ReplyTo]
 	if !ok {
 		p.ReplyTo = 0
-		return
+		return false
 	}
 
 	target.Replies = append(target.Replies,
@@ -125,6 +148,7 @@ func (t *thread) BindReply(p *post) {
 
 	t.PostById[p.ReplyTo].PreTemplate()
 	t.PostById[p.ReplyTo] = target
+	return true
 }
 
 func (t *thread) AddPost(p *post) {
@@ -163,19 +187,28 @@ func (t *thread) AddPost(p *post) {
 	p.TimeString = p.Time.Format(settings.General.PostTimeFormat)
 
 	t.incrementMediaCounts(p)
+	if len(t.Posts) == 0 {
+		t.Created = p.Time
+	}
+	if !p.IsBot() {
+		t.LastPost = p.Time
+	}
 	t.Updated = p.Time
 	t.UpdatedString = p.Time.Format(settings.General.PostTimeFormat)
 	t.Posts = append(t.Posts, p)
 	t.PostById[p.LocalId] = p
 	t.PostsByAddr[p.UserAddr] = append(t.PostsByAddr[p.UserAddr], p)
-	t.BindReply(p)
+	bound := t.BindReply(p)
 	p.PreTemplate()
 
 	t.UpdateThreadSummary()
 	pageCache.SetStale(string(t.Id), t.Hidden)
 
 	if !p.Recovered {
-		t.broadcastPost(p.Bytes)
+		t.broadcast(postAddedEvent(p))
+		if bound {
+			t.broadcast(replyBoundEvent(p))
+		}
 	}
 }
 
@@ -283,28 +316,13 @@ type wsRegister struct {
 	Finished chan bool
 }
 
-// template the post, loop over sockets and write to them. If writing
-// fails, remove the socket from the listener slice.
-func (t *thread) broadcastPost(buf []byte) {
-	msg := string(buf)
-
-	end := len(t.Listeners) - 1
-	for i := 0; i <= end; i++ {
-		ws := t.Listeners[i].Sock
-		if ws == nil {
-			continue
-		}
-
-		ws.SetReadDeadline(time.Now().Add(time.Duration(30 * time.Second)))
-		_, err := io.WriteString(ws, msg)
-		if err != nil {
-			// log.Println("Write failed, closing socket.")
-			ws.Close()
-			t.Listeners[i].Sock = nil
-			t.Listeners[i].Done <- true
-			close(t.Listeners[i].Done)
-		}
+// Small element telling websocket listeners to remove a hidden post.
+func templateHiddenMarker(p *post) []byte {
+	buf := new(bytes.Buffer)
+	if e := templates.ExecuteTemplate(buf, "post_hidden", p); e != nil {
+		log.Println(e)
 	}
+	return buf.Bytes()
 }
 
 func templateBytes(t *thread, view string) []byte {
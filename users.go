@@ -10,8 +10,10 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -47,7 +49,7 @@ func (um *userMap) IsUserBanned(addr string) *userBan {
 
 	ban := um.getUser(addr).Ban
 
-	if ban != nil && time.Now().Before(ban.End) {
+	if ban != nil && ban.IsActive() {
 		return ban
 	} else {
 		return nil
@@ -76,7 +78,7 @@ func (um *userMap) IssueBanByName(addr string, name string) *userBan {
 func (um *userMap) IssueBan(addr string, reason banReason) *userBan {
 	log.Println("issuing ban")
 	ban := createBan(addr, reason)
-	persistBan <- ban
+	queueBan(ban)
 	um.mtx.Lock()
 	defer um.mtx.Unlock()
 	um.getUser(addr).Ban = ban
@@ -194,41 +196,223 @@ func (um *userMap) IsPageViewAllowed(
 }
 
 type userBan struct {
-	Addr     string
-	Reason   banReason
-	Start    time.Time
-	End      time.Time
-	Duration time.Duration
+	Addr       string
+	Reason     banReason
+	Start      time.Time
+	End        time.Time
+	Duration   time.Duration
+	Revocation *banRevocation
+	Appeal     *banAppeal
 }
 
-func (um *userMap) readBans() {
+// Record of a ban being lifted early by staff.
+type banRevocation struct {
+	Staff  string
+	Reason string
+	Time   time.Time
+}
+
+func (b *userBan) IsActive() bool {
+	return time.Now().Before(b.End)
+}
+
+// Return all bans which have not yet expired, soonest expiring first.
+func (um *userMap) ActiveBans() []*userBan {
+	um.mtx.RLock()
+	defer um.mtx.RUnlock()
+
+	out := banList{}
+	for _, user := range um.users {
+		if user.Ban != nil && user.Ban.IsActive() {
+			out = append(out, user.Ban)
+		}
+	}
+
+	sort.Sort(out)
+	return out
+}
+
+// Set a new length in days for an active ban, counted from its start.
+func (um *userMap) EditBan(addr string, days uint64) error {
 	um.mtx.Lock()
 	defer um.mtx.Unlock()
 
-	query := ("SELECT user_addr, reason, description, start_time, end_time " +
-		"FROM bans;")
+	ban := um.getUser(addr).Ban
+	if ban == nil || !ban.IsActive() {
+		return errors.New("ban_not_exist")
+	}
 
-	rows, e := db.Query(query)
-	if e != nil {
+	ban.Reason.Length = days
+	ban.Duration = time.Duration(days) * time.Hour * 24
+	ban.End = ban.Start.Add(ban.Duration)
+	if e := store.UpdateBanEnd(ban); e != nil {
 		log.Panic(e)
 	}
-	defer rows.Close()
+	return nil
+}
 
-	for rows.Next() {
-		ban := &userBan{}
-		var start, end int64
-		e := rows.Scan(&ban.Addr, &ban.Reason.Name, &ban.Reason.Description,
-			&start, &end)
+// Lift an active ban immediately, keeping note of who lifted it and why.
+func (um *userMap) RevokeBan(addr, staff, reason string) error {
+	um.mtx.Lock()
+	defer um.mtx.Unlock()
 
-		if e != nil {
-			log.Panic(e)
+	return um.revokeBan(addr, staff, reason)
+}
+
+func (um *userMap) revokeBan(addr, staff, reason string) error {
+	ban := um.getUser(addr).Ban
+	if ban == nil || !ban.IsActive() {
+		return errors.New("ban_not_exist")
+	}
+
+	now := time.Now()
+	ban.Revocation = &banRevocation{staff, reason, now}
+	ban.End = now
+	ban.Duration = ban.End.Sub(ban.Start)
+	if e := store.UpdateBanEnd(ban); e != nil {
+		log.Panic(e)
+	}
+	if e := store.InsertBanRevocation(ban); e != nil {
+		log.Panic(e)
+	}
+	return nil
+}
+
+// A banned user's request to have their ban lifted. Only one appeal may be
+// made per ban.
+type banAppeal struct {
+	Text     string
+	Time     time.Time
+	Status   string // "pending", "accepted" or "denied"
+	Staff    string
+	Response string
+	Decided  time.Time
+	Post     postGid // Post in the hive's appeal queue.
+}
+
+// Attach an appeal to the user's active ban.
+func (um *userMap) AppealBan(addr, text string) (*userBan, error) {
+	um.mtx.Lock()
+	defer um.mtx.Unlock()
+
+	ban := um.getUser(addr).Ban
+	if ban == nil || !ban.IsActive() {
+		return nil, errors.New("ban_not_exist")
+	}
+
+	if ban.Appeal != nil {
+		return nil, errors.New("already_appealed")
+	}
+
+	ban.Appeal = &banAppeal{Text: text, Time: time.Now(), Status: "pending"}
+	if e := store.InsertBanAppeal(ban); e != nil {
+		log.Panic(e)
+	}
+	return ban, nil
+}
+
+// Accept or deny a pending appeal. Accepting revokes the ban.
+func (um *userMap) DecideAppeal(addr, staff, response string,
+	accept bool) (*banAppeal, error) {
+
+	um.mtx.Lock()
+	defer um.mtx.Unlock()
+
+	ban := um.getUser(addr).Ban
+	if ban == nil || ban.Appeal == nil || ban.Appeal.Status != "pending" {
+		return nil, errors.New("appeal_not_exist")
+	}
+
+	// Revoke first, so a failure leaves the appeal pending.
+	status := "denied"
+	if accept {
+		if e := um.revokeBan(addr, staff, "Appeal accepted"); e != nil {
+			return nil, e
 		}
+		status = "accepted"
+	}
+
+	appeal := ban.Appeal
+	appeal.Status = status
+	appeal.Staff = staff
+	appeal.Response = response
+	appeal.Decided = time.Now()
+
+	if e := store.UpdateBanAppeal(ban); e != nil {
+		log.Panic(e)
+	}
+	return appeal, nil
+}
+
+// Return bans with appeals still awaiting a decision.
+func (um *userMap) PendingAppeals() []*userBan {
+	um.mtx.RLock()
+	defer um.mtx.RUnlock()
+
+	out := banList{}
+	for _, user := range um.users {
+		ban := user.Ban
+		if ban != nil && ban.Appeal != nil && ban.Appeal.Status == "pending" {
+			out = append(out, ban)
+		}
+	}
+
+	sort.Sort(out)
+	return out
+}
+
+// sort interface implementation for bans.
+type banList []*userBan
+
+func (bl banList) Len() int      { return len(bl) }
+func (bl banList) Swap(i, j int) { bl[i], bl[j] = bl[j], bl[i] }
+func (bl banList) Less(i, j int) bool {
+	return bl[i].End.Before(bl[j].End)
+}
 
-		ban.Start = time.Unix(start, 0)
-		ban.End = time.Unix(end, 0)
-		ban.Duration = ban.End.Sub(ban.Start)
+func (um *userMap) readBans() {
+	um.mtx.Lock()
+	defer um.mtx.Unlock()
+
+	e := store.ReadBans(func(ban *userBan) {
 		um.getUser(ban.Addr).Ban = ban
 		log.Println(ban)
+	})
+
+	if e != nil {
+		log.Panic(e)
+	}
+
+	um.readBanRevocations()
+	um.readBanAppeals()
+}
+
+// attach revocation records to the bans they lifted.
+func (um *userMap) readBanRevocations() {
+	e := store.ReadBanRevocations(
+		func(addr string, start int64, r *banRevocation) {
+			ban := um.getUser(addr).Ban
+			if ban != nil && ban.Start.Unix() == start {
+				ban.Revocation = r
+			}
+		})
+
+	if e != nil {
+		log.Panic(e)
+	}
+}
+
+// attach appeals to the bans they were made against.
+func (um *userMap) readBanAppeals() {
+	e := store.ReadBanAppeals(func(addr string, start int64, a *banAppeal) {
+		ban := um.getUser(addr).Ban
+		if ban != nil && ban.Start.Unix() == start {
+			ban.Appeal = a
+		}
+	})
+
+	if e != nil {
+		log.Panic(e)
 	}
 }
 
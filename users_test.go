@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestBanAppeals(t *testing.T) {
+	const addr = "192.0.2.1"
+
+	cases := []struct {
+		name   string
+		ban    bool   // Whether the user has an active ban.
+		appeal string // Status of an earlier appeal, "" for none.
+		action string // "appeal", "accept" or "deny".
+		err    string
+		status string // Status of the appeal afterwards, "" for none.
+		active bool   // Whether the ban is active afterwards.
+	}{
+		{"appeal without ban", false, "", "appeal", "ban_not_exist", "", false},
+		{"appeal", true, "", "appeal", "", "pending", true},
+		{"appeal twice", true, "pending", "appeal", "already_appealed",
+			"pending", true},
+		{"appeal after denial", true, "denied", "appeal", "already_appealed",
+			"denied", true},
+		{"accept", true, "pending", "accept", "", "accepted", false},
+		{"deny", true, "pending", "deny", "", "denied", true},
+		{"accept without appeal", true, "", "accept", "appeal_not_exist",
+			"", true},
+		{"accept after denial", true, "denied", "accept", "appeal_not_exist",
+			"denied", true},
+		{"deny without ban", false, "", "deny", "appeal_not_exist", "", false},
+	}
+
+	settings = &tolxankaConfigToml{}
+	for _, c := range cases {
+		store = testSQLiteStorage(t)
+
+		if c.ban {
+			ban := createBan(addr, banReason{Name: "spam", Length: 1})
+			if e := store.InsertBans([]*userBan{ban}); e != nil {
+				t.Fatal(e)
+			}
+
+			if c.appeal != "" {
+				ban.Appeal = &banAppeal{Text: "sorry", Time: ban.Start,
+					Status: c.appeal}
+				if e := store.InsertBanAppeal(ban); e != nil {
+					t.Fatal(e)
+				}
+				if e := store.UpdateBanAppeal(ban); e != nil {
+					t.Fatal(e)
+				}
+			}
+		}
+
+		um := newUserMap()
+		var e error
+		switch c.action {
+		case "appeal":
+			_, e = um.AppealBan(addr, "please")
+		case "accept", "deny":
+			_, e = um.DecideAppeal(addr, "mod", "ok", c.action == "accept")
+		}
+
+		var got string
+		if e != nil {
+			got = e.Error()
+		}
+		if got != c.err {
+			t.Errorf("%s: error %q, want %q", c.name, got, c.err)
+		}
+
+		// The outcome must survive a restart as well.
+		recovered := newUserMap()
+		for _, users := range []*userMap{&um, &recovered} {
+			var status string
+			var active bool
+			if ban := users.getUser(addr).Ban; ban != nil {
+				active = ban.IsActive()
+				if ban.Appeal != nil {
+					status = ban.Appeal.Status
+				}
+			}
+
+			if status != c.status || active != c.active {
+				t.Errorf("%s: appeal %q and ban active %v, want %q and %v",
+					c.name, status, active, c.status, c.active)
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+//
+// websocket.go
+//
+// Thread update events sent to websocket listeners. Listeners registered
+// with the "events" protocol receive a JSON envelope for every event;
+// listeners using the original protocol receive only the raw HTML of new
+// posts and hidden post markers.
+//
+// Each listener has its own bounded send queue drained by a writer
+// goroutine, so broadcasting from the sequencer never waits on a socket.
+// Listeners whose queue overflows are dropped.
+
+package main
+
+import (
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of open websocket connections across all threads.
+var liveSockets int64
+
+type wsRegistration struct {
+	Thread threadId
+	Done   chan bool // Closed once the listener is finished.
+	Sock   *websocket.Conn
+	Events bool        // Listener wants JSON event envelopes, not raw HTML.
+	Send   chan []byte // Outbound message queue.
+
+	finish     chan bool // Closed to have the writer flush and exit.
+	once       sync.Once
+	finishOnce sync.Once
+}
+
+func newWsRegistration(tid threadId, ws *websocket.Conn,
+	events bool) *wsRegistration {
+
+	atomic.AddInt64(&liveSockets, 1)
+	return &wsRegistration{
+		Thread: tid,
+		Done:   make(chan bool),
+		Sock:   ws,
+		Events: events,
+		Send:   make(chan []byte, settings.Sockets.QueueSize),
+		finish: make(chan bool),
+	}
+}
+
+// Close the socket and release the waiting handler. Safe to call more than
+// once and from any goroutine.
+func (reg *wsRegistration) Close() {
+	reg.once.Do(func() {
+		close(reg.Done)
+		reg.Sock.Close()
+		atomic.AddInt64(&liveSockets, -1)
+	})
+}
+
+// Queue a last message and close once everything queued has been written.
+func (reg *wsRegistration) CloseAfter(msg []byte) {
+	if msg != nil {
+		reg.Queue(msg)
+	}
+
+	reg.finishOnce.Do(func() {
+		close(reg.finish)
+	})
+}
+
+func (reg *wsRegistration) IsDone() bool {
+	select {
+	case <-reg.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Queue message without blocking. If the queue is full the listener is
+// too far behind and is closed.
+func (reg *wsRegistration) Queue(msg []byte) bool {
+	select {
+	case reg.Send <- msg:
+		return true
+	case <-reg.Done:
+		return false
+	default:
+		log.Printf("websocket listener on thread %s overflowed, dropping",
+			reg.Thread)
+		reg.Close()
+		return false
+	}
+}
+
+// Write queued messages and keepalive pings until the listener is closed.
+func (reg *wsRegistration) writeLoop() {
+	ticker := time.NewTicker(settings.Sockets.PingInterval.Duration)
+	defer ticker.Stop()
+	defer reg.Close()
+
+	write := func(payloadType byte, msg []byte) bool {
+		timeout := settings.Sockets.WriteTimeout.Duration
+		reg.Sock.SetWriteDeadline(time.Now().Add(timeout))
+		reg.Sock.PayloadType = payloadType
+		_, e := reg.Sock.Write(msg)
+		reg.Sock.PayloadType = websocket.TextFrame
+		return e == nil
+	}
+
+	for {
+		select {
+		case msg := <-reg.Send:
+			if !write(websocket.TextFrame, msg) {
+				return
+			}
+
+		case <-ticker.C:
+			var ok bool
+			if reg.Events {
+				ok = write(websocket.TextFrame, pingEnvelope)
+			} else {
+				ok = write(websocket.PingFrame, []byte{})
+			}
+
+			if !ok {
+				return
+			}
+
+		case <-reg.finish:
+			for {
+				select {
+				case msg := <-reg.Send:
+					if !write(websocket.TextFrame, msg) {
+						return
+					}
+				default:
+					return
+				}
+			}
+
+		case <-reg.Done:
+			return
+		}
+	}
+}
+
+// Read until the client goes away. Listeners on the events protocol must
+// answer each ping within PongWait; older clients never send anything, so
+// for them this only notices the socket closing.
+func (reg *wsRegistration) readLoop() {
+	defer reg.Close()
+	buf := make([]byte, 512)
+
+	for {
+		if reg.Events {
+			wait := settings.Sockets.PongWait.Duration
+			reg.Sock.SetReadDeadline(time.Now().Add(wait))
+		}
+
+		if _, e := reg.Sock.Read(buf); e != nil {
+			return
+		}
+	}
+}
+
+// Drop closed listeners from the thread.
+func (t *thread) pruneListeners() {
+	live := t.Listeners[:0]
+	for _, reg := range t.Listeners {
+		if !reg.IsDone() {
+			live = append(live, reg)
+		}
+	}
+
+	for i := len(live); i < len(t.Listeners); i++ {
+		t.Listeners[i] = nil
+	}
+
+	t.Listeners = live
+}
+
+const (
+	eventPing          = "ping"
+	eventShutdown      = "server_shutdown"
+	eventPostAdded     = "post_added"
+	eventPostHidden    = "post_hidden"
+	eventReplyBound    = "reply_bound"
+	eventThreadLocked  = "thread_locked"
+	eventThreadSticky  = "thread_stickied"
+	eventThreadDeleted = "thread_deleted"
+)
+
+type wsEvent struct {
+	Type   string   `json:"type"`
+	Thread threadId `json:"thread"`
+	Lid    postLid  `json:"lid,omitempty"`
+	Target postLid  `json:"target,omitempty"`
+	Locked bool     `json:"locked,omitempty"`
+	Sticky []string `json:"sticky_tags,omitempty"`
+	Post   *apiPost `json:"post,omitempty"`
+	Html   string   `json:"html,omitempty"`
+
+	raw      []byte // Message for listeners using the raw HTML protocol.
+	envelope []byte // Marshalled event, once needed.
+}
+
+var pingEnvelope, _ = json.Marshal(wsEvent{Type: eventPing})
+
+func postAddedEvent(p *post) *wsEvent {
+	ap := newAPIPost(p)
+	return &wsEvent{
+		Type:   eventPostAdded,
+		Thread: p.ParentThread,
+		Lid:    p.LocalId,
+		Post:   &ap,
+		Html:   string(p.Bytes),
+		raw:    p.Bytes,
+	}
+}
+
+func postHiddenEvent(p *post) *wsEvent {
+	return &wsEvent{
+		Type:   eventPostHidden,
+		Thread: p.ParentThread,
+		Lid:    p.LocalId,
+		raw:    templateHiddenMarker(p),
+	}
+}
+
+func replyBoundEvent(p *post) *wsEvent {
+	return &wsEvent{
+		Type:   eventReplyBound,
+		Thread: p.ParentThread,
+		Lid:    p.LocalId,
+		Target: p.ReplyTo,
+	}
+}
+
+func threadLockedEvent(t *thread) *wsEvent {
+	return &wsEvent{
+		Type:   eventThreadLocked,
+		Thread: t.Id,
+		Locked: t.Locked,
+	}
+}
+
+// Sent whenever a thread's sticky tags change; an empty list means it is no
+// longer sticky anywhere.
+func threadStickiedEvent(t *thread) *wsEvent {
+	return &wsEvent{
+		Type:   eventThreadSticky,
+		Thread: t.Id,
+		Sticky: t.StickyTags,
+	}
+}
+
+func threadDeletedEvent(t *thread) *wsEvent {
+	return &wsEvent{Type: eventThreadDeleted, Thread: t.Id}
+}
+
+func shutdownEvent(t *thread) *wsEvent {
+	return &wsEvent{Type: eventShutdown, Thread: t.Id}
+}
+
+// Message for a listener in the format it asked for, or nil if the event
+// has no equivalent in that format.
+func (ev *wsEvent) messageFor(reg *wsRegistration) []byte {
+	if !reg.Events {
+		return ev.raw
+	}
+
+	if ev.envelope == nil {
+		var e error
+		if ev.envelope, e = json.Marshal(ev); e != nil {
+			log.Println(e)
+		}
+	}
+	return ev.envelope
+}
+
+// queue the event on each socket in the format it asked for, dropping
+// listeners that have closed or fallen behind.
+func (t *thread) broadcast(ev *wsEvent) {
+	for _, reg := range t.Listeners {
+		if msg := ev.messageFor(reg); msg != nil {
+			reg.Queue(msg)
+		}
+	}
+
+	t.pruneListeners()
+}
+
+// Send a final event to every listener and close them.
+func (t *thread) closeListeners(ev *wsEvent) {
+	for _, reg := range t.Listeners {
+		reg.CloseAfter(ev.messageFor(reg))
+	}
+
+	t.Listeners = []*wsRegistration{}
+}
+
+// Close every listener on every thread, waiting up to timeout for final
+// messages to be written.
+func closeAllListeners(timeout time.Duration) {
+	closing := []*wsRegistration{}
+
+	hiveReq(func(h *hive) {
+		for _, t := range h.Threads {
+			closing = append(closing, t.Listeners...)
+			t.closeListeners(shutdownEvent(t))
+		}
+	})
+
+	deadline := time.After(timeout)
+	for _, reg := range closing {
+		select {
+		case <-reg.Done:
+		case <-deadline:
+			log.Println("timed out closing websocket listeners")
+			return
+		}
+	}
+}
+
+// Report open websocket connections in total and per thread.
+func showSocketStats(w http.ResponseWriter, r *http.Request) {
+	if getStaffRole(r).Title == "" {
+		msg(w, 404, "404")
+		return
+	}
+
+	stats := struct {
+		Total   int64            `json:"total"`
+		Threads map[threadId]int `json:"threads"`
+	}{atomic.LoadInt64(&liveSockets), map[threadId]int{}}
+
+	hiveReq(func(h *hive) {
+		for _, t := range h.Threads {
+			t.pruneListeners()
+			if n := len(t.Listeners); n > 0 {
+				stats.Threads[t.Id] = n
+			}
+		}
+	})
+
+	writeJSON(w, marshalAPI(stats))
+}